@@ -6,8 +6,11 @@ import (
 	"github.com/pkg/errors"
 	"sync"
 	"sync/atomic"
+	"time"
 	"tiny-badger/config"
+	"tiny-badger/skl"
 	"tiny-badger/structs"
+	"tiny-badger/table"
 	"tiny-badger/utils"
 )
 
@@ -15,6 +18,8 @@ const (
 	kvWriteChCapacity = 1000
 )
 
+var errNoRoom = errors.New("No room for write")
+
 var requestPool = sync.Pool{
 	New: func() interface{} {
 		return new(request)
@@ -22,7 +27,9 @@ var requestPool = sync.Pool{
 }
 
 type closers struct {
-	writes *z.Closer
+	writes     *z.Closer
+	memtable   *z.Closer
+	compactors *z.Closer
 }
 
 type DB struct {
@@ -33,8 +40,15 @@ type DB struct {
 	mt         *MemTable   // current active memtable
 	imm        []*MemTable // immutable memtables
 	nextMemFid int
+	flushChan  chan *MemTable // immutable memtables waiting to be flushed
+
+	lc       *levelsController
+	manifest *manifestFile
+	vlog     valueLog
+	orc      *oracle
 
-	isClosed atomic.Uint32
+	isClosed  atomic.Uint32
+	closeLock sync.RWMutex // makes the sends to writeCh exclusive with closing the DB
 
 	lock sync.RWMutex // guards list of inmemory tables
 
@@ -42,21 +56,64 @@ type DB struct {
 }
 
 func Open(opts config.Options) (*DB, error) {
+	// a batch is written into the memtable as a whole, so it must be much smaller than the memtable
+	if opts.MaxBatchSize == 0 {
+		opts.MaxBatchSize = opts.MemtableSize * 15 / 100
+	}
+	if opts.MaxBatchCount == 0 {
+		opts.MaxBatchCount = opts.MaxBatchSize / int64(skl.MaxNodeSize)
+	}
+	// the full memtable waits in flushChan, so there must be room for at least one
+	if opts.NumMemtables < 1 {
+		opts.NumMemtables = 1
+	}
 	db := &DB{
-		writeCh: make(chan *request, kvWriteChCapacity),
-		imm:     make([]*MemTable, 0),
-		opts:    opts,
-		log:     utils.NewDefaultLogger(utils.ERROR),
+		writeCh:   make(chan *request, kvWriteChCapacity),
+		imm:       make([]*MemTable, 0),
+		flushChan: make(chan *MemTable, opts.NumMemtables),
+		opts:      opts,
+		log:       utils.NewDefaultLogger(utils.ERROR),
+		orc:       newOracle(opts.ManagedTxns),
 	}
 	var err error
 
 	if err := db.openMemTables(); err != nil {
 		return nil, utils.Wrapf(err, "while open memtables")
 	}
+	manifest := createManifest()
+	if !db.opts.InMemory {
+		if db.manifest, manifest, err = openOrCreateManifestFile(db.opts.Dir, db.opts.ReadOnly); err != nil {
+			return nil, utils.Wrapf(err, "while open manifest")
+		}
+	}
+	if db.lc, err = newLevelsController(db, &manifest); err != nil {
+		_ = db.manifest.close()
+		return nil, utils.Wrapf(err, "while open levels")
+	}
+	if err := db.vlog.open(db); err != nil {
+		_ = db.lc.close()
+		_ = db.manifest.close()
+		return nil, utils.Wrapf(err, "while open value log")
+	}
 	if !db.opts.ReadOnly {
 		if db.mt, err = db.newMemTable(); err != nil {
 			return nil, utils.Wrapf(err, "create new memtable")
 		}
+
+		db.closers.memtable = z.NewCloser(1)
+		go db.flushMemtable(db.closers.memtable)
+		// flush the memtables recovered from WAL
+		for _, mt := range db.imm {
+			db.flushChan <- mt
+		}
+	}
+
+	// the next transaction commits after all the versions recovered
+	db.orc.init(db.maxVersion())
+
+	db.closers.compactors = z.NewCloser(0)
+	if !db.opts.ReadOnly {
+		db.lc.startCompact(db.closers.compactors)
 	}
 
 	db.closers.writes = z.NewCloser(1)
@@ -66,6 +123,11 @@ func Open(opts config.Options) (*DB, error) {
 }
 
 func (db *DB) Close() error {
+	// reject the new writes, the ones sent before are drained by doWrites
+	db.closeLock.Lock()
+	db.isClosed.Store(1)
+	db.closeLock.Unlock()
+
 	// send HasBeenClosed signal, gracefully close writes
 	db.closers.writes.SignalAndWait()
 	close(db.writeCh)
@@ -75,14 +137,37 @@ func (db *DB) Close() error {
 			// remove memtable
 			db.mt.DecrRef()
 		} else {
-			// todo flush memtable
+			db.lock.Lock()
+			db.imm = append(db.imm, db.mt)
+			db.lock.Unlock()
+			db.flushChan <- db.mt
 		}
 	}
+	if !db.opts.ReadOnly {
+		// wait for all the immutable memtables to be flushed
+		close(db.flushChan)
+		db.closers.memtable.Wait()
+	}
+	db.closers.compactors.SignalAndWait()
+	db.orc.stop()
 
-	return nil
+	err := db.lc.close()
+	err = utils.CombineErrors(err, db.manifest.close())
+	return utils.CombineErrors(err, db.vlog.close())
 }
 
+// sendToWriteCh sends entries to be written, it returns ErrDBClosed once the DB is closing
 func (db *DB) sendToWriteCh(entries []*structs.Entry) (*request, error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+	if db.IsClosed() {
+		return nil, utils.ErrDBClosed
+	}
+	return db.sendToWriteChLocked(entries), nil
+}
+
+// sendToWriteChLocked must be called with closeLock read locked, and the DB not closed
+func (db *DB) sendToWriteChLocked(entries []*structs.Entry) *request {
 	// todo calc metrics and determine whether to execute next request
 
 	req := requestPool.Get().(*request)
@@ -91,7 +176,7 @@ func (db *DB) sendToWriteCh(entries []*structs.Entry) (*request, error) {
 	req.Wg.Add(1)
 	db.writeCh <- req // handled in doWrites
 
-	return req, nil
+	return req
 }
 
 // doWrites handles concurrent writes to memtable in sequential order in a batch
@@ -231,8 +316,12 @@ func (db *DB) writeRequests(reqs []*request) error {
 		}
 	}
 
-	// 1, write to value log
-	db.log.Debugf("writeRequests called. Writing to value log... (not suppported now)")
+	// 1, write the large values to value log
+	db.log.Debugf("writeRequests called. Writing to value log")
+	if err := db.vlog.write(reqs); err != nil {
+		done(err)
+		return errors.Wrap(err, "writeRequests")
+	}
 
 	// 2. write to memtable
 	db.log.Debugf("Writing to memtable")
@@ -243,6 +332,15 @@ func (db *DB) writeRequests(reqs []*request) error {
 		}
 		count++
 
+		var err error
+		for err = db.ensureRoomForWrite(); err == errNoRoom; err = db.ensureRoomForWrite() {
+			// wait for the flusher to drain flushChan
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			done(err)
+			return errors.Wrap(err, "writeRequests")
+		}
 		if err := db.writeToLSM(req); err != nil {
 			done(err)
 			return errors.Wrap(err, "writeRequests")
@@ -254,15 +352,106 @@ func (db *DB) writeRequests(reqs []*request) error {
 	return nil
 }
 
+// ensureRoomForWrite moves the full memtable to db.imm and replaces it with a new one,
+// returns errNoRoom if there are too many memtables waiting to be flushed
+func (db *DB) ensureRoomForWrite() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if !db.mt.isFull() {
+		return nil
+	}
+	if err := db.mt.SyncWal(); err != nil {
+		return utils.Wrapf(err, "while syncing wal of full memtable")
+	}
+
+	// flushChan is only sent to by the write goroutine while open, the room checked here stays free
+	if len(db.flushChan) == cap(db.flushChan) {
+		return errNoRoom
+	}
+	// create the new memtable first, so the full one stays in place if it fails
+	mt, err := db.newMemTable()
+	if err != nil {
+		return utils.Wrapf(err, "cannot create new memtable")
+	}
+	db.flushChan <- db.mt
+	db.imm = append(db.imm, db.mt)
+	db.mt = mt
+	db.log.Debugf("memtable is full, %d immutable memtables", len(db.imm))
+	return nil
+}
+
+// flushMemtable keeps flushing the memtables from flushChan to L0 tables until it's closed
+func (db *DB) flushMemtable(lc *z.Closer) {
+	defer lc.Done()
+
+	for mt := range db.flushChan {
+		for {
+			if err := db.handleMemTableFlush(mt); err != nil {
+				db.log.Errorf("while flushing memtable: %v, retrying", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			db.lock.Lock()
+			// flushChan keeps the same order as db.imm
+			utils.AssertTrue(mt == db.imm[0])
+			db.imm = db.imm[1:]
+			// the WAL is deleted once the readers release the memtable
+			mt.DecrRef()
+			db.lock.Unlock()
+			break
+		}
+	}
+}
+
+// handleMemTableFlush writes the memtable to a new L0 table
+func (db *DB) handleMemTableFlush(mt *MemTable) error {
+	b := buildL0Table(mt, db.opts)
+	if b.Empty() {
+		return nil
+	}
+
+	tbl, err := db.lc.createTable(b)
+	if err != nil {
+		return utils.Wrapf(err, "failed to build L0 table")
+	}
+	if !db.opts.InMemory {
+		// make sure the table file is durable before the WAL is removed
+		if err := z.SyncDir(db.opts.Dir); err != nil {
+			_ = tbl.DecrRef()
+			return utils.Wrapf(err, "while syncing dir %s", db.opts.Dir)
+		}
+	}
+	return db.lc.addLevel0Table(tbl)
+}
+
+func buildL0Table(mt *MemTable, opts config.Options) *table.Builder {
+	iter := skl.NewIterator(mt.skl)
+	defer iter.Close()
+
+	b := table.NewTableBuilder(opts)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		b.Add(iter.Key(), iter.Value())
+	}
+	return b
+}
+
 func (db *DB) writeToLSM(req *request) error {
-	for _, entry := range req.Entries {
-		// todo set threshold if value is too large, and write the value pointer to memtable
-		if err := db.mt.Put(entry.Key, structs.ValueStruct{
+	utils.AssertTrue(len(req.Ptrs) == len(req.Entries))
+	for i, entry := range req.Entries {
+		vs := structs.ValueStruct{
 			Value:     entry.Value,
 			ExpiresAt: entry.ExpiresAt,
-			Meta:      entry.Meta, // todo set bitValuePointer??
+			Meta:      entry.Meta &^ structs.BitValuePointer,
 			UserMeta:  entry.UserMeta,
-		}); err != nil {
+		}
+		if !req.Ptrs[i].IsZero() {
+			// the value has been written to value log, only keep the pointer in memtable
+			vs.Value = req.Ptrs[i].Encode()
+			vs.Meta |= structs.BitValuePointer
+		}
+		if err := db.mt.Put(entry.Key, vs); err != nil {
 			return utils.Wrapf(err, "while writing to memTable")
 		}
 	}
@@ -272,13 +461,56 @@ func (db *DB) writeToLSM(req *request) error {
 	return nil
 }
 
+// RunValueLogGC rewrites a vlog file if at least discardRatio of the sampled bytes are garbage, the
+// file is deleted once no transaction reads from it. It returns ErrNoRewrite if nothing is cleaned
+// up, so it could be called repeatedly until ErrNoRewrite to reclaim more space.
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	if db.opts.InMemory {
+		return utils.ErrGCInMemoryMode
+	}
+	if db.opts.ReadOnly || discardRatio <= 0.0 || discardRatio >= 1.0 {
+		return utils.ErrInvalidRequest
+	}
+	if db.IsClosed() {
+		return utils.ErrDBClosed
+	}
+	return db.vlog.runGC(discardRatio)
+}
+
+// SetDiscardTs tells compaction that the versions at or below ts are invisible to the readers in
+// managed mode, so they could be dropped if they're shadowed, keeping Options.NumVersionsToKeep
+func (db *DB) SetDiscardTs(ts uint64) {
+	if !db.opts.ManagedTxns {
+		panic("Cannot use SetDiscardTs with ManagedTxns=false.")
+	}
+	db.orc.setDiscardTs(ts)
+}
+
+// maxVersion returns the max version of the keys in memtables and tables, it's called before any write
+func (db *DB) maxVersion() uint64 {
+	maxVersion := db.lc.maxVersion()
+	update := func(mt *MemTable) {
+		if mt != nil && mt.maxVersion > maxVersion {
+			maxVersion = mt.maxVersion
+		}
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	update(db.mt)
+	for _, mt := range db.imm {
+		update(mt)
+	}
+	return maxVersion
+}
+
 func (db *DB) IsClosed() bool {
 	return db.isClosed.Load() == 1
 }
 
+// arenaSize leaves room for the batch which pushes the memtable over MemtableSize, same as the WAL
 func (db *DB) arenaSize() int64 {
-	// todo calc the correct arena size
-	return db.opts.MemtableSize
+	return 2 * db.opts.MemtableSize
 }
 
 func (db *DB) get(key []byte) (structs.ValueStruct, error) {
@@ -297,18 +529,17 @@ func (db *DB) get(key []byte) (structs.ValueStruct, error) {
 		if vs.Meta == 0 && vs.Value == nil {
 			continue
 		}
-		// found the value from latest table
+		// found the exact version from latest table
 		if vs.Version == version {
 			return vs, nil
 		}
+		// the latest memtable might keep an older version rewritten by vlog GC, keep looking for newer ones
 		if maxVs.Version < vs.Version {
 			maxVs = vs
 		}
 	}
 
-	return maxVs, nil
-	// todo get from level controller
-	//return structs.ValueStruct{}, nil
+	return db.lc.Get(key, maxVs, 0)
 }
 
 // getMemtables from latest records to the oldest records
@@ -2,9 +2,15 @@ package tiny_badger
 
 import (
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 	"tiny-badger/config"
+	"tiny-badger/skl"
 	"tiny-badger/structs"
 	"tiny-badger/utils"
 )
@@ -30,11 +36,13 @@ func getRequest() *request {
 }
 
 func getItemValue(t *testing.T, item *Item) []byte {
-	return item.vptr
+	val, err := item.ValueCopy(nil)
+	require.NoError(t, err)
+	return val
 }
 
 func txnSet(t *testing.T, kv *DB, key []byte, value []byte, meta byte) {
-	txn := kv.NewTransaction()
+	txn := kv.NewTransaction(true)
 	require.NoError(t, txn.SetEntry(structs.NewEntry(key, value).WithMeta(meta)))
 	require.NoError(t, txn.Commit())
 }
@@ -62,6 +70,7 @@ func TestDB_writeToLSM(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		req := getRequest()
 		defer req.Wg.Done()
+		require.NoError(t, db.vlog.write([]*request{req}))
 		err := db.writeToLSM(req)
 		require.NoError(t, err)
 	})
@@ -96,19 +105,205 @@ func TestDB_sendToWriteCh(t *testing.T) {
 func TestWrite(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		for i := 0; i < 20; i++ {
-			txnSet(t, db, utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 0), []byte(fmt.Sprintf("val%d", i)), 0x00)
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0x00)
 		}
 	})
 }
 
 func TestGet(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
-		txnSet(t, db, utils.KeyWithTs([]byte("key1"), 0), []byte("val1"), 0x08)
+		txnSet(t, db, []byte("key1"), []byte("val1"), 0x08)
 
-		txn := db.NewTransaction()
+		txn := db.NewTransaction(true)
 		item, err := txn.Get([]byte("key1"))
 		require.NoError(t, err)
 		require.Equal(t, []byte("val1"), getItemValue(t, item))
 		txn.Discard()
 	})
 }
+
+// copyDir copies the files of src to dst, the files of an open DB are copied as if it crashed
+func copyDir(t *testing.T, src, dst string) {
+	files, err := os.ReadDir(src)
+	require.NoError(t, err)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(src, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dst, file.Name()), data, 0666))
+	}
+}
+
+func TestReopenReplaysMemtable(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+	crashDir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(crashDir)
+
+	opts := config.DefaultOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0x00)
+	}
+	// the keys only live in the WAL of the memtable when it crashes
+	copyDir(t, dir, crashDir)
+	require.NoError(t, db.Close())
+
+	// the read-only DB doesn't flush the memtable replayed
+	opts.Dir = crashDir
+	opts.ReadOnly = true
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Len(t, db.imm, 1)
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	for i := 0; i < 20; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", i)), getItemValue(t, item))
+	}
+}
+
+func getL0Keys(t *testing.T, db *DB) [][]byte {
+	l0 := db.lc.levels[0]
+	l0.RLock()
+	defer l0.RUnlock()
+
+	var keys [][]byte
+	for _, tbl := range l0.tables {
+		it := tbl.NewIterator()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, utils.SafeCopy(nil, it.Key()))
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+	}
+	return keys
+}
+
+func TestCloseFlushesMemtable(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("val%d", i)), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Empty(t, db.imm)
+
+	keys := getL0Keys(t, db)
+	require.Len(t, keys, 20)
+	for i, key := range keys {
+		// every transaction commits at a new timestamp
+		require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("key%02d", i)), uint64(i+1)), key)
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	for i := 0; i < 20; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%02d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", i)), getItemValue(t, item))
+	}
+	_, err = txn.Get([]byte("key20"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestMemtableRotation(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.MemtableSize = 64 << 10
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		n := 2000
+		for i := 0; i < n; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), newValue(i), 0x00)
+		}
+		require.False(t, db.mt.isFull())
+
+		// wait for the flusher
+		require.Eventually(t, func() bool {
+			db.lock.RLock()
+			defer db.lock.RUnlock()
+			return len(db.imm) == 0
+		}, 10*time.Second, 10*time.Millisecond)
+
+		mtKeys := 0
+		iter := skl.NewIterator(db.mt.skl)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			mtKeys++
+		}
+		require.NoError(t, iter.Close())
+		require.NotEmpty(t, db.lc.levels[0].tables)
+		require.Equal(t, n, mtKeys+len(getL0Keys(t, db)))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+			require.Equal(t, newValue(i), getItemValue(t, item))
+		}
+	})
+}
+
+func TestZeroNumMemtables(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.MemtableSize = 64 << 10
+	opts.NumMemtables = 0
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.Equal(t, 1, db.opts.NumMemtables)
+		// the memtable is rotated several times
+		for i := 0; i < 2000; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), newValue(i), 0x00)
+		}
+		require.Eventually(t, func() bool {
+			db.lc.levels[0].RLock()
+			defer db.lc.levels[0].RUnlock()
+			return len(db.lc.levels[0].tables) > 0
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestSendToWriteChRacingClose(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	db, err := Open(config.DefaultOptions(dir))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := utils.KeyWithTs([]byte(fmt.Sprintf("key%d-%d", i, j)), 1)
+				req, err := db.sendToWriteCh([]*structs.Entry{structs.NewEntry(key, []byte("val"))})
+				if err != nil {
+					assert.Equal(t, utils.ErrDBClosed, err)
+					return
+				}
+				// the requests sent before closing are still written
+				assert.NoError(t, req.Wait())
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Close())
+	wg.Wait()
+
+	_, err = db.sendToWriteCh([]*structs.Entry{structs.NewEntry([]byte("key"), []byte("val"))})
+	require.Equal(t, utils.ErrDBClosed, err)
+}
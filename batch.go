@@ -0,0 +1,156 @@
+package tiny_badger
+
+import (
+	"sync"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+// maxPendingBatches is the max batches of a WriteBatch being written at the same time
+const maxPendingBatches = 16
+
+// WriteBatch writes lots of entries without the round-trip of a transaction per write. The entries
+// are split into batches, and each batch is committed in the background once it reaches
+// Options.MaxBatchCount or Options.MaxBatchSize, so there is no atomicity across the batches and the
+// writes never conflict.
+type WriteBatch struct {
+	sync.Mutex
+	db       *DB
+	txn      *Txn
+	commitTs uint64 // all the batches are committed at commitTs in managed mode
+
+	throttle chan struct{} // bounds the batches in flight
+	wg       sync.WaitGroup
+	errLock  sync.Mutex
+	err      error // the first error met by the batches
+	finished bool
+}
+
+// NewWriteBatch returns a WriteBatch, Flush must be called to write all the entries, or Cancel to
+// drop the ones not written yet
+func (db *DB) NewWriteBatch() *WriteBatch {
+	if db.opts.ManagedTxns {
+		panic("Cannot use NewWriteBatch with ManagedTxns=true. Use NewWriteBatchAt instead.")
+	}
+	return &WriteBatch{
+		db:       db,
+		txn:      db.newBatchTxn(),
+		throttle: make(chan struct{}, maxPendingBatches),
+	}
+}
+
+// NewWriteBatchAt returns a WriteBatch which writes all the entries at commitTs in managed mode
+func (db *DB) NewWriteBatchAt(commitTs uint64) *WriteBatch {
+	if !db.opts.ManagedTxns {
+		panic("Cannot use NewWriteBatchAt with ManagedTxns=false. Use NewWriteBatch instead.")
+	}
+	return &WriteBatch{
+		db:       db,
+		txn:      db.newBatchTxn(),
+		commitTs: commitTs,
+		throttle: make(chan struct{}, maxPendingBatches),
+	}
+}
+
+func (wb *WriteBatch) Set(key, value []byte) error {
+	return wb.SetEntry(structs.NewEntry(key, value))
+}
+
+// Delete writes a tombstone of key
+func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.SetEntry(&structs.Entry{Key: key, Meta: structs.BitDelete})
+}
+
+// SetEntry adds e to the current batch, the batch is committed first if e doesn't fit in it. It
+// returns the error met by the batches committed before.
+func (wb *WriteBatch) SetEntry(e *structs.Entry) error {
+	wb.Lock()
+	defer wb.Unlock()
+
+	if wb.finished {
+		return utils.ErrDiscardedTxn
+	}
+	if err := wb.Error(); err != nil {
+		return err
+	}
+	if err := wb.txn.SetEntry(e); err != utils.ErrTxnTooBig {
+		return err
+	}
+	if err := wb.commit(); err != nil {
+		return err
+	}
+	return wb.txn.SetEntry(e)
+}
+
+// commit sends the current batch to be written in the background and starts a new one, must be
+// called with lock held
+func (wb *WriteBatch) commit() error {
+	if len(wb.txn.pendingWrites) == 0 {
+		return nil
+	}
+	wb.throttle <- struct{}{}
+	wb.wg.Add(1)
+	txn := wb.txn
+	wb.txn = wb.db.newBatchTxn()
+	if wb.commitTs > 0 {
+		_ = txn.CommitAt(wb.commitTs, wb.callback)
+	} else {
+		txn.CommitWith(wb.callback)
+	}
+	return wb.Error()
+}
+
+// callback records the error of a batch committed
+func (wb *WriteBatch) callback(err error) {
+	defer wb.wg.Done()
+	if err != nil {
+		wb.setError(err)
+	}
+	<-wb.throttle
+}
+
+func (wb *WriteBatch) setError(err error) {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	if wb.err == nil {
+		wb.err = err
+	}
+}
+
+// Error returns the first error met by the batches committed
+func (wb *WriteBatch) Error() error {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	return wb.err
+}
+
+// Flush commits the current batch and waits for all the batches to be written, it returns the
+// first error met. The WriteBatch can't be used after that.
+func (wb *WriteBatch) Flush() error {
+	wb.Lock()
+	defer wb.Unlock()
+
+	if wb.finished {
+		return utils.ErrDiscardedTxn
+	}
+	wb.finished = true
+	if wb.Error() == nil {
+		_ = wb.commit()
+	}
+	wb.txn.Discard()
+	wb.wg.Wait()
+	return wb.Error()
+}
+
+// Cancel drops the current batch and waits for the batches being written
+func (wb *WriteBatch) Cancel() {
+	wb.Lock()
+	defer wb.Unlock()
+
+	if wb.finished {
+		return
+	}
+	wb.finished = true
+	wb.txn.Discard()
+	wb.wg.Wait()
+}
@@ -0,0 +1,123 @@
+package tiny_badger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"tiny-badger/config"
+	"tiny-badger/utils"
+)
+
+func TestWriteBatch(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.MemtableSize = 1 << 20
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		n := 20000
+		before := db.orc.nextTxnTs
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%05d", i)), newValue(i)))
+		}
+		for i := 0; i < n; i += 2 {
+			require.NoError(t, wb.Delete([]byte(fmt.Sprintf("key%05d", i))))
+		}
+		require.NoError(t, wb.Flush())
+		// the entries are split into several batches
+		require.Greater(t, db.orc.nextTxnTs-before, uint64(1))
+		require.Equal(t, utils.ErrDiscardedTxn, wb.Set([]byte("key"), []byte("val")))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if i%2 == 0 {
+				require.Equal(t, utils.ErrKeyNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, newValue(i), getItemValue(t, item))
+		}
+	})
+}
+
+func TestWriteBatchCancel(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		require.NoError(t, wb.Set([]byte("key"), []byte("val")))
+		wb.Cancel()
+		require.Equal(t, utils.ErrDiscardedTxn, wb.Flush())
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		_, err := txn.Get([]byte("key"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+	})
+}
+
+func TestWriteBatchPendingBatches(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.MaxBatchCount = 10
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// stall the writes to memtable, so the batches committed stay pending
+		db.lock.RLock()
+		wb := db.NewWriteBatch()
+		n := 100
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < n; i++ {
+				require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%03d", i)), newValue(i)))
+			}
+		}()
+		// a commit waiting for the batch before it would hold at most 2 throttle slots
+		pending := assert.Eventually(t, func() bool {
+			return len(wb.throttle) > 2
+		}, 5*time.Second, 10*time.Millisecond)
+		db.lock.RUnlock()
+		require.True(t, pending)
+		<-done
+		require.NoError(t, wb.Flush())
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, newValue(i), getItemValue(t, item))
+		}
+		// the blind writes neither register as readers nor conflict with anything, only txn reads
+		require.EqualValues(t, 1, db.vlog.numActiveReaders.Load())
+		db.orc.Lock()
+		require.Empty(t, db.orc.committedTxns)
+		db.orc.Unlock()
+	})
+}
+
+func TestWriteBatchClose(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.MaxBatchCount = 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	wb := db.NewWriteBatch()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			// the batches committed after closing fail rather than panic
+			if err := wb.Set([]byte(fmt.Sprintf("key%d", i)), newValue(i)); err != nil {
+				assert.Equal(t, utils.ErrDBClosed, err)
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Close())
+	<-done
+	require.Equal(t, utils.ErrDBClosed, wb.Flush())
+}
@@ -0,0 +1,327 @@
+package tiny_badger
+
+import (
+	"bytes"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"tiny-badger/structs"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+// keyRange is a range of user keys, both sides are inclusive
+type keyRange struct {
+	left  []byte
+	right []byte
+}
+
+func getKeyRange(tables ...*table.Table) keyRange {
+	if len(tables) == 0 {
+		return keyRange{}
+	}
+	kr := keyRange{
+		left:  utils.ParseKey(tables[0].Smallest()),
+		right: utils.ParseKey(tables[0].Biggest()),
+	}
+	for _, t := range tables[1:] {
+		if left := utils.ParseKey(t.Smallest()); bytes.Compare(left, kr.left) < 0 {
+			kr.left = left
+		}
+		if right := utils.ParseKey(t.Biggest()); bytes.Compare(right, kr.right) > 0 {
+			kr.right = right
+		}
+	}
+	return kr
+}
+
+func (r keyRange) overlapsWith(dst keyRange) bool {
+	return bytes.Compare(r.left, dst.right) <= 0 && bytes.Compare(dst.left, r.right) <= 0
+}
+
+// compactStatus tracks the levels being compacted, a compaction from level L holds both L and L+1,
+// so the compactors could work on different levels concurrently
+type compactStatus struct {
+	sync.Mutex
+	busy []bool
+}
+
+func (cs *compactStatus) tryLock(level int) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.busy[level] || cs.busy[level+1] {
+		return false
+	}
+	cs.busy[level], cs.busy[level+1] = true, true
+	return true
+}
+
+func (cs *compactStatus) unlock(level int) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.busy[level], cs.busy[level+1] = false, false
+}
+
+// compactDef describes the tables to merge from thisLevel to nextLevel
+type compactDef struct {
+	thisLevel *levelHandler
+	nextLevel *levelHandler
+	top       []*table.Table // newest first for L0
+	bot       []*table.Table
+}
+
+type levelScore struct {
+	level int
+	score float64
+}
+
+// startCompact launches NumCompactors goroutines to compact the levels in background
+func (lc *levelsController) startCompact(closer *z.Closer) {
+	n := lc.db.opts.NumCompactors
+	closer.AddRunning(n)
+	for i := 0; i < n; i++ {
+		go lc.runCompactor(i, closer)
+	}
+}
+
+func (lc *levelsController) runCompactor(id int, closer *z.Closer) {
+	defer closer.Done()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, ls := range lc.pickCompactLevels() {
+				if !lc.cstatus.tryLock(ls.level) {
+					continue
+				}
+				err := lc.doCompact(ls.level)
+				lc.cstatus.unlock(ls.level)
+				if err != nil {
+					lc.db.log.Errorf("compactor %d: while compacting level %d: %v", id, ls.level, err)
+				}
+				break
+			}
+		case <-closer.HasBeenClosed():
+			return
+		}
+	}
+}
+
+// levelTargetSize is BaseLevelSize for L1, and multiplied by LevelSizeMultiplier for each level below
+func (lc *levelsController) levelTargetSize(level int) int64 {
+	utils.AssertTrue(level > 0)
+	return lc.db.opts.BaseLevelSize * int64(math.Pow(float64(lc.db.opts.LevelSizeMultiplier), float64(level-1)))
+}
+
+// pickCompactLevels scores the levels by how much they are over the budget, returns the levels
+// with score >= 1 in descending order of score. The last level is never compacted.
+func (lc *levelsController) pickCompactLevels() []levelScore {
+	var scores []levelScore
+	for _, l := range lc.levels[:len(lc.levels)-1] {
+		var score float64
+		if l.level == 0 {
+			score = float64(l.numTables()) / float64(lc.db.opts.NumLevelZeroTables)
+		} else {
+			score = float64(l.totalSize()) / float64(lc.levelTargetSize(l.level))
+		}
+		if score >= 1 {
+			scores = append(scores, levelScore{level: l.level, score: score})
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+	return scores
+}
+
+// doCompact merges the tables of level into the overlapping tables of the next level
+func (lc *levelsController) doCompact(level int) error {
+	cd := compactDef{
+		thisLevel: lc.levels[level],
+		nextLevel: lc.levels[level+1],
+	}
+
+	cd.thisLevel.RLock()
+	cd.nextLevel.RLock()
+	if level == 0 {
+		for i := len(cd.thisLevel.tables) - 1; i >= 0; i-- {
+			cd.top = append(cd.top, cd.thisLevel.tables[i])
+		}
+	} else if len(cd.thisLevel.tables) > 0 {
+		// pick the table with the oldest data
+		top := cd.thisLevel.tables[0]
+		for _, t := range cd.thisLevel.tables[1:] {
+			if t.MaxVersion() < top.MaxVersion() {
+				top = t
+			}
+		}
+		cd.top = []*table.Table{top}
+	}
+	cd.bot = cd.nextLevel.overlappingTables(getKeyRange(cd.top...))
+	cd.nextLevel.RUnlock()
+	cd.thisLevel.RUnlock()
+
+	if len(cd.top) == 0 {
+		return nil
+	}
+
+	if level > 0 && len(cd.bot) == 0 {
+		// nothing to merge with, just move the table down
+		changes := []manifestChange{newDeleteChange(cd.top[0].ID()), newCreateChange(cd.top[0].ID(), level+1)}
+		if err := lc.db.manifest.addChanges(changes); err != nil {
+			return utils.Wrapf(err, "while moving table %d in manifest", cd.top[0].ID())
+		}
+		cd.top[0].IncrRef()
+		if err := cd.nextLevel.replaceTables(nil, cd.top); err != nil {
+			return err
+		}
+		lc.db.log.Debugf("moved table %d from level %d to %d", cd.top[0].ID(), level, level+1)
+		return cd.thisLevel.deleteTables(cd.top)
+	}
+
+	newTables, err := lc.compactBuildTables(cd)
+	if err != nil {
+		return utils.Wrapf(err, "while building tables for level %d", level)
+	}
+	if err := lc.db.manifest.addChanges(buildChangeSet(cd, newTables)); err != nil {
+		_ = decrRefs(newTables)
+		return utils.Wrapf(err, "while adding compaction of level %d to manifest", level)
+	}
+	if err := cd.nextLevel.replaceTables(cd.bot, newTables); err != nil {
+		return err
+	}
+	lc.db.log.Debugf("compacted %d+%d tables from level %d into %d tables",
+		len(cd.top), len(cd.bot), level, len(newTables))
+	return cd.thisLevel.deleteTables(cd.top)
+}
+
+// buildChangeSet creates newTables at next level and deletes the merged tables
+func buildChangeSet(cd compactDef, newTables []*table.Table) []manifestChange {
+	changes := make([]manifestChange, 0, len(newTables)+len(cd.top)+len(cd.bot))
+	for _, t := range newTables {
+		changes = append(changes, newCreateChange(t.ID(), cd.nextLevel.level))
+	}
+	for _, t := range cd.top {
+		changes = append(changes, newDeleteChange(t.ID()))
+	}
+	for _, t := range cd.bot {
+		changes = append(changes, newDeleteChange(t.ID()))
+	}
+	return changes
+}
+
+// compactBuildTables merges top and bot into new tables, drops the versions which are invisible to
+// all the readers, and the deleted or expired keys if there is no older data below the next level
+func (lc *levelsController) compactBuildTables(cd compactDef) ([]*table.Table, error) {
+	var iters []table.Iterator
+	for _, t := range cd.top {
+		iters = append(iters, t.NewIterator())
+	}
+	iters = append(iters, table.NewConcatIterator(cd.bot, false))
+	it := table.NewMergeIterator(iters, false)
+	defer it.Close()
+
+	discardTs := lc.db.orc.discardAtOrBelow()
+	dropDeleted := !lc.hasOverlapBelow(getKeyRange(append(cd.top, cd.bot...)...), cd.nextLevel.level+1)
+
+	var newTables []*table.Table
+	abort := func(err error) ([]*table.Table, error) {
+		_ = decrRefs(newTables)
+		return nil, err
+	}
+	var builder *table.Builder
+	finishTable := func() error {
+		if builder == nil || builder.Empty() {
+			return nil
+		}
+		t, err := lc.createTable(builder)
+		if err != nil {
+			return err
+		}
+		newTables = append(newTables, t)
+		builder = nil
+		return nil
+	}
+
+	// bytes of the discarded values in each vlog file
+	discardStats := make(map[uint32]int64)
+	updateStats := func(vs structs.ValueStruct) {
+		if vs.Meta&structs.BitValuePointer > 0 {
+			var vp structs.ValuePointer
+			vp.Decode(vs.Value)
+			discardStats[vp.Fid] += int64(vp.Len)
+		}
+	}
+
+	var lastKey, skipKey []byte
+	var numVersions int // versions of lastKey which are invisible to all the readers
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Key()
+		vs := it.Value()
+		if !utils.SameKey(key, lastKey) {
+			// only split tables between different user keys, so the tables of next level never overlap
+			if builder != nil && builder.ReachedCapacity(lc.db.opts.BaseTableSize) {
+				if err := finishTable(); err != nil {
+					return abort(err)
+				}
+			}
+			lastKey = utils.SafeCopy(lastKey, key)
+			skipKey = skipKey[:0]
+			numVersions = 0
+		}
+		if len(skipKey) > 0 && utils.SameKey(key, skipKey) {
+			// shadowed by a newer version which is visible to all the readers
+			updateStats(vs)
+			continue
+		}
+		if utils.ParseTs(key) <= discardTs {
+			// keep NumVersionsToKeep versions, a tombstone hides all the older versions
+			numVersions++
+			isDeleted := structs.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+			if isDeleted || numVersions >= lc.db.opts.NumVersionsToKeep {
+				skipKey = utils.SafeCopy(skipKey, key)
+				if isDeleted && dropDeleted {
+					updateStats(vs)
+					continue
+				}
+			}
+		}
+
+		if builder == nil {
+			builder = table.NewTableBuilder(lc.db.opts)
+		}
+		builder.Add(key, vs)
+	}
+
+	// make sure no data is dropped because of a corrupted block
+	if err := it.Error(); err != nil {
+		return abort(err)
+	}
+	if err := finishTable(); err != nil {
+		return abort(err)
+	}
+	if !lc.db.opts.InMemory {
+		if err := z.SyncDir(lc.db.opts.Dir); err != nil {
+			return abort(utils.Wrapf(err, "while syncing dir %s", lc.db.opts.Dir))
+		}
+	}
+	lc.db.vlog.updateDiscardStats(discardStats)
+	return newTables, nil
+}
+
+// hasOverlapBelow checks whether any table from level overlaps with the key range
+func (lc *levelsController) hasOverlapBelow(kr keyRange, level int) bool {
+	for _, l := range lc.levels[level:] {
+		l.RLock()
+		overlap := len(l.overlappingTables(kr)) > 0
+		l.RUnlock()
+		if overlap {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package tiny_badger
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+func TestCompaction(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.MemtableSize = 64 << 10
+	opts.BaseTableSize = 32 << 10
+	opts.BaseLevelSize = 128 << 10
+	opts.NumLevelZeroTables = 2
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		n := 3000
+		for round := 0; round < 3; round++ {
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				txnSet(t, db, key, []byte(fmt.Sprintf("val%05d-%d", i, round)), 0x00)
+			}
+		}
+
+		require.Eventually(t, func() bool {
+			return len(db.lc.pickCompactLevels()) == 0
+		}, 10*time.Second, 10*time.Millisecond)
+
+		// the tables of L1+ are sorted and never overlap
+		var below int
+		for _, l := range db.lc.levels[1:] {
+			l.RLock()
+			below += len(l.tables)
+			for i := 1; i < len(l.tables); i++ {
+				prev := utils.ParseKey(l.tables[i-1].Biggest())
+				require.Less(t, bytes.Compare(prev, utils.ParseKey(l.tables[i].Smallest())), 0)
+			}
+			l.RUnlock()
+		}
+		require.Greater(t, below, 0)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%05d-2", i)), getItemValue(t, item))
+		}
+	})
+}
+
+func TestCompactionDropsExpiredAtBottom(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.NumCompactors = 0
+	// tables are installed without manifest
+	opts.InMemory = true
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// L0 expires the even keys of L1
+		b := table.NewTableBuilder(db.opts)
+		for i := 0; i < 100; i++ {
+			vs := structs.ValueStruct{Value: []byte(fmt.Sprintf("%05dnew", i))}
+			if i%2 == 0 {
+				vs.ExpiresAt = 1
+			}
+			b.Add(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), vs)
+		}
+		l0, err := db.lc.createTable(b)
+		require.NoError(t, err)
+		db.lc.levels[0].initTables([]*table.Table{l0})
+		db.lc.levels[1].initTables([]*table.Table{buildTestTable(t, db.lc.reserveFileID(), 0, 100, "old")})
+
+		require.NoError(t, db.lc.doCompact(0))
+		require.Equal(t, 0, db.lc.levels[0].numTables())
+		require.Equal(t, 1, db.lc.levels[1].numTables())
+
+		it := db.lc.levels[1].tables[0].NewIterator()
+		defer it.Close()
+		i := 1
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), it.Key())
+			require.Equal(t, []byte(fmt.Sprintf("%05dnew", i)), it.Value().Value)
+			i += 2
+		}
+		require.Equal(t, 101, i)
+	})
+}
+
+func TestCompactionKeepsExpiredAboveOlderData(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.NumCompactors = 0
+	opts.InMemory = true
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		b := table.NewTableBuilder(db.opts)
+		b.Add(utils.KeyWithTs([]byte("00001"), 0), structs.ValueStruct{Value: []byte("expired"), ExpiresAt: 1})
+		l0, err := db.lc.createTable(b)
+		require.NoError(t, err)
+		db.lc.levels[0].initTables([]*table.Table{l0})
+		// the older value lives in L2, the expired entry must shadow it
+		db.lc.levels[2].initTables([]*table.Table{buildTestTable(t, db.lc.reserveFileID(), 0, 10, "old")})
+
+		require.NoError(t, db.lc.doCompact(0))
+		vs, err := db.lc.levels[1].get(utils.KeyWithTs([]byte("00001"), 0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("expired"), vs.Value)
+	})
+}
+
+func TestCompactionDiscardStats(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.NumCompactors = 0
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// the even keys point to expired values in vlog file 1
+		vp := structs.ValuePointer{Fid: 1, Len: 100, Offset: vlogHeaderSize}
+		b := table.NewTableBuilder(db.opts)
+		for i := 0; i < 100; i++ {
+			vs := structs.ValueStruct{Value: vp.Encode(), Meta: structs.BitValuePointer}
+			if i%2 == 0 {
+				vs.ExpiresAt = 1
+			}
+			b.Add(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), vs)
+		}
+		l0, err := db.lc.createTable(b)
+		require.NoError(t, err)
+		require.NoError(t, db.manifest.addChanges([]manifestChange{newCreateChange(l0.ID(), 0)}))
+		db.lc.levels[0].initTables([]*table.Table{l0})
+
+		require.NoError(t, db.lc.doCompact(0))
+		fid, discard := db.vlog.discardStats.MaxDiscard()
+		require.EqualValues(t, 1, fid)
+		require.EqualValues(t, 50*vp.Len, discard)
+	})
+}
+
+func TestLevelTargetSize(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.NumCompactors = 0
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.Equal(t, opts.BaseLevelSize, db.lc.levelTargetSize(1))
+		require.Equal(t, opts.BaseLevelSize*10, db.lc.levelTargetSize(2))
+		require.Equal(t, opts.BaseLevelSize*100, db.lc.levelTargetSize(3))
+	})
+}
+
+func TestCompactionNumVersionsToKeep(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	opts.NumVersionsToKeep = 2
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		txnSet(t, db, []byte("key"), []byte(fmt.Sprintf("val%d", i)), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.lc.doCompact(0))
+
+	var versions []uint64
+	for _, tbl := range db.lc.levels[1].tables {
+		it := tbl.NewIterator()
+		for it.Rewind(); it.Valid(); it.Next() {
+			versions = append(versions, utils.ParseTs(it.Key()))
+		}
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, []uint64{4, 3}, versions)
+
+	txn := db.NewTransactionAt(3, false)
+	defer txn.Discard()
+	item, err := txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val3"), getItemValue(t, item))
+	old := db.NewTransactionAt(2, false)
+	defer old.Discard()
+	_, err = old.Get([]byte("key"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestCompactionKeepsSnapshot(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	opts.NumVersionsToKeep = 1
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		txnSet(t, db, []byte("key"), []byte(fmt.Sprintf("val%d", i)), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	// the snapshot at 2 is still read, so val2 is kept even though it's shadowed
+	old := db.NewTransactionAt(2, false)
+	require.EqualValues(t, 1, db.orc.discardAtOrBelow())
+	require.NoError(t, db.lc.doCompact(0))
+	item, err := old.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val2"), getItemValue(t, item))
+	old.Discard()
+	require.EqualValues(t, 4, db.orc.discardAtOrBelow())
+}
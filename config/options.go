@@ -6,8 +6,32 @@ type Options struct {
 	SyncWrites bool
 	InMemory   bool
 	ReadOnly   bool
+	// the callers supply the timestamps of the transactions, see DB.NewTransactionAt
+	ManagedTxns bool
+	// times DB.Update retries on ErrConflict
+	NumUpdateRetries int
 
 	MemtableSize int64
+	NumMemtables int
+	// limits of the writes in a transaction, derived from MemtableSize in Open if they're 0
+	MaxBatchCount int64
+	MaxBatchSize  int64
+
+	// values larger than ValueThreshold are stored in the value log
+	ValueThreshold   int64
+	ValueLogFileSize int64
+
+	MaxLevels int
+	BlockSize int
+
+	// compaction
+	NumCompactors           int
+	NumVersionsToKeep       int // versions of a key kept by compaction once they're invisible to all the readers
+	BaseTableSize           int64
+	BaseLevelSize           int64
+	LevelSizeMultiplier     int
+	NumLevelZeroTables      int
+	NumLevelZeroTablesStall int
 }
 
 func DefaultOptions(path string) Options {
@@ -18,6 +42,24 @@ func DefaultOptions(path string) Options {
 		InMemory:   false,
 		ReadOnly:   false,
 
+		ManagedTxns:      false,
+		NumUpdateRetries: 3,
+
 		MemtableSize: 32 << 20, // 32MB
+		NumMemtables: 5,
+
+		ValueThreshold:   1 << 20, // 1MB
+		ValueLogFileSize: 1<<30 - 1,
+
+		MaxLevels: 7,
+		BlockSize: 4 << 10, // 4KB
+
+		NumCompactors:           2,
+		NumVersionsToKeep:       1,
+		BaseTableSize:           2 << 20,  // 2MB
+		BaseLevelSize:           10 << 20, // 10MB
+		LevelSizeMultiplier:     10,
+		NumLevelZeroTables:      5,
+		NumLevelZeroTablesStall: 15,
 	}
 }
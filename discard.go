@@ -0,0 +1,170 @@
+package tiny_badger
+
+import (
+	"encoding/binary"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"tiny-badger/config"
+	"tiny-badger/utils"
+)
+
+const (
+	discardFname = "DISCARD"
+	// |fid u64|discard u64|
+	discardSlotSize = 16
+)
+
+// discardStats keeps the bytes of discarded values of each vlog file in a mmapped file, the slots
+// are sorted by fid, and the first zero fid marks the end of slots
+// +-----+---------+-----+---------+-----+---+
+// | fid | discard | fid | discard | ... | 0 |
+// +-----+---------+-----+---------+-----+---+
+type discardStats struct {
+	sync.Mutex
+	*z.MmapFile
+	opts          config.Options
+	nextEmptySlot int
+}
+
+func initDiscardStats(opts config.Options) (*discardStats, error) {
+	path := filepath.Join(opts.Dir, discardFname)
+	mf, err := z.OpenMmapFile(path, os.O_CREATE|os.O_RDWR, 1<<20)
+	lf := &discardStats{
+		MmapFile: mf,
+		opts:     opts,
+	}
+	if err == z.NewFile {
+		lf.zeroOut()
+	} else if err != nil {
+		return nil, utils.Wrapf(err, "while opening file: %s", path)
+	}
+
+	for slot := 0; slot < lf.maxSlot(); slot++ {
+		if lf.get(slot*discardSlotSize) == 0 {
+			lf.nextEmptySlot = slot
+			break
+		}
+	}
+	sort.Sort(lf)
+	return lf, nil
+}
+
+func (lf *discardStats) Len() int {
+	return lf.nextEmptySlot
+}
+
+func (lf *discardStats) Less(i, j int) bool {
+	return lf.get(i*discardSlotSize) < lf.get(j*discardSlotSize)
+}
+
+func (lf *discardStats) Swap(i, j int) {
+	left := lf.Data[i*discardSlotSize : i*discardSlotSize+discardSlotSize]
+	right := lf.Data[j*discardSlotSize : j*discardSlotSize+discardSlotSize]
+	var tmp [discardSlotSize]byte
+	copy(tmp[:], left)
+	copy(left, right)
+	copy(right, tmp[:])
+}
+
+func (lf *discardStats) maxSlot() int {
+	return len(lf.Data) / discardSlotSize
+}
+
+func (lf *discardStats) get(offset int) uint64 {
+	return binary.BigEndian.Uint64(lf.Data[offset : offset+8])
+}
+
+func (lf *discardStats) set(offset int, val uint64) {
+	binary.BigEndian.PutUint64(lf.Data[offset:offset+8], val)
+}
+
+// zeroOut the next empty slot, so it marks the end of slots
+func (lf *discardStats) zeroOut() {
+	lf.set(lf.nextEmptySlot*discardSlotSize, 0)
+	lf.set(lf.nextEmptySlot*discardSlotSize+8, 0)
+}
+
+// Update adds discard to the stats of fid and returns the result. A zero discard just queries the
+// current value, and a negative one resets it to 0.
+func (lf *discardStats) Update(fidu uint32, discard int64) int64 {
+	if lf == nil {
+		return 0
+	}
+	fid := uint64(fidu)
+	lf.Lock()
+	defer lf.Unlock()
+
+	idx := sort.Search(lf.nextEmptySlot, func(slot int) bool {
+		return lf.get(slot*discardSlotSize) >= fid
+	})
+	if idx < lf.nextEmptySlot && lf.get(idx*discardSlotSize) == fid {
+		off := idx*discardSlotSize + 8
+		curDisc := lf.get(off)
+		if discard == 0 {
+			return int64(curDisc)
+		}
+		if discard < 0 {
+			lf.set(off, 0)
+			return 0
+		}
+		lf.set(off, curDisc+uint64(discard))
+		return int64(curDisc + uint64(discard))
+	}
+	if discard <= 0 {
+		// no stats for fid
+		return 0
+	}
+
+	// append a new slot and keep the slots sorted
+	idx = lf.nextEmptySlot
+	lf.set(idx*discardSlotSize, fid)
+	lf.set(idx*discardSlotSize+8, uint64(discard))
+	lf.nextEmptySlot++
+	for lf.nextEmptySlot >= lf.maxSlot() {
+		utils.Check(lf.Truncate(2 * int64(len(lf.Data))))
+	}
+	lf.zeroOut()
+	sort.Sort(lf)
+	return discard
+}
+
+// Iterate calls f for the stats of every vlog file
+func (lf *discardStats) Iterate(f func(fid, stats uint64)) {
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		idx := slot * discardSlotSize
+		f(lf.get(idx), lf.get(idx+8))
+	}
+}
+
+// MaxDiscard returns the vlog file with the most discarded bytes
+func (lf *discardStats) MaxDiscard() (uint32, int64) {
+	return lf.maxDiscardOf(func(uint32) bool { return true })
+}
+
+// maxDiscardOf returns the vlog file with the most discarded bytes among the ones accepted by keep
+func (lf *discardStats) maxDiscardOf(keep func(fid uint32) bool) (uint32, int64) {
+	if lf == nil {
+		return 0, 0
+	}
+	lf.Lock()
+	defer lf.Unlock()
+
+	var maxFid, maxVal uint64
+	lf.Iterate(func(fid, val uint64) {
+		if maxVal < val && keep(uint32(fid)) {
+			maxVal = val
+			maxFid = fid
+		}
+	})
+	return uint32(maxFid), int64(maxVal)
+}
+
+func (lf *discardStats) close() error {
+	if lf == nil {
+		return nil
+	}
+	return lf.MmapFile.Close(-1)
+}
@@ -0,0 +1,72 @@
+package tiny_badger
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/utils"
+)
+
+func TestDiscardStats(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-discard-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	ds, err := initDiscardStats(opts)
+	require.NoError(t, err)
+	require.Zero(t, ds.nextEmptySlot)
+	fid, discard := ds.MaxDiscard()
+	require.Zero(t, fid)
+	require.Zero(t, discard)
+
+	for _, i := range []uint32{20, 10, 30} {
+		require.EqualValues(t, i*10, ds.Update(i, int64(i*10)))
+	}
+	require.EqualValues(t, 3, ds.nextEmptySlot)
+	require.EqualValues(t, 400, ds.Update(10, 300))
+	require.EqualValues(t, 400, ds.Update(10, 0))
+	fid, discard = ds.MaxDiscard()
+	require.EqualValues(t, 10, fid)
+	require.EqualValues(t, 400, discard)
+
+	// reset the stats of fid 10
+	require.Zero(t, ds.Update(10, -1))
+	fid, discard = ds.MaxDiscard()
+	require.EqualValues(t, 30, fid)
+	require.EqualValues(t, 300, discard)
+	// the unknown fid is not added
+	require.Zero(t, ds.Update(40, 0))
+	require.EqualValues(t, 3, ds.nextEmptySlot)
+	require.NoError(t, ds.close())
+
+	// the stats are restored sorted by fid
+	ds, err = initDiscardStats(opts)
+	require.NoError(t, err)
+	defer ds.close()
+	require.EqualValues(t, 3, ds.nextEmptySlot)
+	var fids []uint64
+	ds.Iterate(func(fid, _ uint64) {
+		fids = append(fids, fid)
+	})
+	require.Equal(t, []uint64{10, 20, 30}, fids)
+	require.EqualValues(t, 200, ds.Update(20, 0))
+}
+
+func TestDiscardStatsGrow(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-discard-test")
+	defer utils.DestroyDir(dir)
+
+	ds, err := initDiscardStats(config.DefaultOptions(dir))
+	require.NoError(t, err)
+	defer ds.close()
+	require.NoError(t, ds.Truncate(4*discardSlotSize))
+
+	n := ds.maxSlot() + 10
+	for i := 1; i <= n; i++ {
+		ds.Update(uint32(i), int64(i))
+	}
+	require.Greater(t, ds.maxSlot(), n)
+	fid, discard := ds.MaxDiscard()
+	require.EqualValues(t, n, fid)
+	require.EqualValues(t, n, discard)
+}
@@ -2,15 +2,17 @@ module tiny-badger
 
 go 1.23.5
 
-require github.com/pkg/errors v0.9.1
+require (
+	github.com/dgraph-io/ristretto/v2 v2.1.0
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.10.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/dgraph-io/ristretto/v2 v2.1.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,373 @@
+package tiny_badger
+
+import (
+	"bytes"
+	"sync"
+	"tiny-badger/skl"
+	"tiny-badger/structs"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+// IteratorOptions is used to set options when iterating over the keys
+type IteratorOptions struct {
+	// fetch the values of the next PrefetchSize items concurrently, which helps when the values
+	// live in the value log
+	PrefetchValues bool
+	PrefetchSize   int
+	// only iterate the keys, the values are never read and Item.Value returns ErrKeysOnly
+	KeysOnly bool
+
+	Prefix     []byte // only iterate over the keys with this prefix
+	LowerBound []byte // only iterate over the keys >= LowerBound
+	UpperBound []byte // only iterate over the keys < UpperBound
+	Reverse    bool   // iterate in descending order of the keys
+	// yield all the versions of the keys from the newest to the oldest, including the tombstones
+	// and the expired ones, check them with Item.IsDeletedOrExpired
+	AllVersions bool
+}
+
+// DefaultIteratorOptions iterates all the keys in ascending order, and prefetches the values of the
+// next 100 items
+var DefaultIteratorOptions = IteratorOptions{
+	PrefetchValues: true,
+	PrefetchSize:   100,
+}
+
+// numPrefetchWorkers is the max goroutines which fetch the values for an iterator
+const numPrefetchWorkers = 8
+
+// lowerBound returns the smallest user key to iterate, nil if it's not bounded
+func (opt *IteratorOptions) lowerBound() []byte {
+	if bytes.Compare(opt.Prefix, opt.LowerBound) > 0 {
+		return opt.Prefix
+	}
+	return opt.LowerBound
+}
+
+// upperBound returns the user key where the iteration stops, nil if it's not bounded
+func (opt *IteratorOptions) upperBound() []byte {
+	upper := prefixSuccessor(opt.Prefix)
+	if upper == nil || (opt.UpperBound != nil && bytes.Compare(opt.UpperBound, upper) < 0) {
+		return opt.UpperBound
+	}
+	return upper
+}
+
+// prefixSuccessor returns the smallest key bigger than all the keys with prefix, nil if there's
+// no such key, e.g. the prefix is empty or consists of 0xff only
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := utils.SafeCopy(nil, prefix[:i+1])
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
+
+// pickTable returns false if the key range of t doesn't intersect with the keys to iterate
+func (opt *IteratorOptions) pickTable(t *table.Table) bool {
+	if lower := opt.lowerBound(); lower != nil && bytes.Compare(utils.ParseKey(t.Biggest()), lower) < 0 {
+		return false
+	}
+	if upper := opt.upperBound(); upper != nil && bytes.Compare(utils.ParseKey(t.Smallest()), upper) >= 0 {
+		return false
+	}
+	return true
+}
+
+// pastEnd returns true if the user key is beyond the end of the iteration, the iteration starts
+// from the lower bound, or the upper bound if it's reversed
+func (it *Iterator) pastEnd(key []byte) bool {
+	if !bytes.HasPrefix(key, it.opt.Prefix) {
+		return true
+	}
+	if it.opt.Reverse {
+		return bytes.Compare(key, it.lower) < 0
+	}
+	return it.upper != nil && bytes.Compare(key, it.upper) >= 0
+}
+
+// Iterator iterates the newest version of the keys visible at readTs of the transaction, the
+// memtables and the tables of all levels are merged together
+type Iterator struct {
+	iitr   *table.MergeIterator
+	txn    *Txn
+	readTs uint64
+	opt    IteratorOptions
+	lower  []byte
+	upper  []byte
+
+	// the current item and the items parsed ahead of it, data[0] is the current one
+	data     []*Item
+	lastKey  []byte  // the last key met, used to skip its older versions
+	versions []*Item // the versions of a key met in reverse order with AllVersions, yielded from the end
+
+	fetchCh chan *Item     // the items whose values are to be fetched by the workers
+	fetchWg sync.WaitGroup // tracks the workers
+	closed  bool
+}
+
+// NewIterator returns an iterator over the snapshot of txn, it must be closed before the
+// transaction is discarded. The items are only valid until the iterator is closed.
+func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
+	if txn.discarded {
+		panic(utils.ErrDiscardedTxn)
+	}
+	if txn.db.IsClosed() {
+		panic(utils.ErrDBClosed)
+	}
+	txn.numIterators.Add(1)
+
+	// the skiplist iterators hold the references of memtables
+	tables, decr := txn.db.getMemtables()
+	defer decr()
+	var iters []table.Iterator
+	for _, mt := range tables {
+		iters = append(iters, skl.NewUniIterator(mt.skl, opt.Reverse))
+	}
+	iters = txn.db.lc.appendIterators(iters, &opt)
+
+	it := &Iterator{
+		iitr:   table.NewMergeIterator(iters, opt.Reverse),
+		txn:    txn,
+		readTs: txn.readTs,
+		opt:    opt,
+		lower:  opt.lowerBound(),
+		upper:  opt.upperBound(),
+	}
+	if it.prefetching() {
+		it.fetchCh = make(chan *Item, opt.PrefetchSize)
+		for i := 0; i < min(opt.PrefetchSize, numPrefetchWorkers); i++ {
+			it.fetchWg.Add(1)
+			go it.fetchWorker()
+		}
+	}
+	return it
+}
+
+func (it *Iterator) prefetching() bool {
+	return it.opt.PrefetchValues && it.opt.PrefetchSize > 1 && !it.opt.KeysOnly
+}
+
+// fetchWorker fetches the values of the items until the iterator is closed
+func (it *Iterator) fetchWorker() {
+	defer it.fetchWg.Done()
+	for item := range it.fetchCh {
+		item.prefetchValue()
+	}
+}
+
+// Rewind moves to the first key within the bounds, or the last one if reversed
+func (it *Iterator) Rewind() {
+	if !it.opt.Reverse && it.lower != nil {
+		it.Seek(it.lower)
+		return
+	}
+	if it.opt.Reverse && it.upper != nil {
+		it.Seek(it.upper)
+		return
+	}
+	it.reset()
+	it.iitr.Rewind()
+	it.fill()
+}
+
+// Seek moves to the first key >= key within the bounds, or the last key <= key if reversed
+func (it *Iterator) Seek(key []byte) {
+	if !it.opt.Reverse && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	if it.opt.Reverse && it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		// the upper bound is excluded by parseItem
+		key = it.upper
+	}
+	if len(key) == 0 {
+		it.Rewind()
+		return
+	}
+	it.reset()
+	if !it.opt.Reverse {
+		it.iitr.Seek(utils.KeyWithTs(key, it.readTs))
+	} else {
+		// the oldest version of key comes first in reverse order
+		it.iitr.Seek(utils.KeyWithTs(key, 0))
+	}
+	it.fill()
+}
+
+// reset drops the items parsed, the values being fetched are left to the workers
+func (it *Iterator) reset() {
+	clear(it.data)
+	it.data = it.data[:0]
+	it.lastKey = it.lastKey[:0]
+	it.versions = it.versions[:0]
+}
+
+func (it *Iterator) Valid() bool {
+	return len(it.data) > 0
+}
+
+// Error returns the error met while reading the tables, such as a corrupted block. Valid returns
+// false once the iterator meets it, so it should be checked after the iteration.
+func (it *Iterator) Error() error {
+	return it.iitr.Error()
+}
+
+// Item returns the current item, it's only valid while the iterator is open. The key is recorded
+// as read here rather than when it's parsed ahead, so the keys prefetched but never reached don't
+// cause conflicts.
+func (it *Iterator) Item() *Item {
+	if !it.Valid() {
+		return nil
+	}
+	item := it.data[0]
+	if !item.read {
+		item.read = true
+		it.txn.addReadKey(item.key)
+	}
+	return item
+}
+
+// Next moves to the next key
+func (it *Iterator) Next() {
+	utils.AssertTrue(it.Valid())
+	it.data[0] = nil
+	it.data = it.data[1:]
+	it.fill()
+}
+
+// fill parses the items ahead until there are PrefetchSize of them, and sends them to the workers
+// to fetch the values
+func (it *Iterator) fill() {
+	size := 1
+	if it.prefetching() {
+		size = it.opt.PrefetchSize
+	}
+	for len(it.data) < size {
+		item := it.parseItem()
+		if item == nil {
+			return
+		}
+		if it.prefetching() {
+			item.wg.Add(1)
+			it.fetchCh <- item
+		}
+		it.data = append(it.data, item)
+	}
+}
+
+// parseItem skips the versions newer than readTs, the older versions of the last key, and the
+// deleted or expired keys unless AllVersions is set. It returns the next item and moves the merged
+// iterator past it, or nil if there are no more keys within the bounds.
+func (it *Iterator) parseItem() *Item {
+	if it.opt.Reverse {
+		return it.parseItemReverse()
+	}
+	for ; it.iitr.Valid(); it.iitr.Next() {
+		key := it.iitr.Key()
+		if it.pastEnd(utils.ParseKey(key)) {
+			return nil
+		}
+		if utils.ParseTs(key) > it.readTs {
+			continue
+		}
+		if it.opt.AllVersions {
+			item := it.newItem(key, it.iitr.Value())
+			it.iitr.Next()
+			return item
+		}
+		if utils.SameKey(key, it.lastKey) {
+			continue
+		}
+		// the newest visible version of the key
+		it.lastKey = utils.SafeCopy(it.lastKey, key)
+		vs := it.iitr.Value()
+		if structs.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			continue
+		}
+		item := it.newItem(key, vs)
+		it.iitr.Next()
+		return item
+	}
+	return nil
+}
+
+// parseItemReverse meets the versions of a key from the oldest to the newest, so it walks all of
+// them to find the newest one visible at readTs, the merged iterator is left at the next key
+func (it *Iterator) parseItemReverse() *Item {
+	if n := len(it.versions); n > 0 {
+		item := it.versions[n-1]
+		it.versions[n-1] = nil
+		it.versions = it.versions[:n-1]
+		return item
+	}
+	for it.iitr.Valid() {
+		userKey := utils.ParseKey(it.iitr.Key())
+		if it.upper != nil && bytes.Compare(userKey, it.upper) >= 0 {
+			it.iitr.Next()
+			continue
+		}
+		if it.pastEnd(userKey) {
+			return nil
+		}
+
+		var vs structs.ValueStruct
+		found := false
+		it.lastKey = utils.SafeCopy(it.lastKey, it.iitr.Key())
+		for ; it.iitr.Valid() && utils.SameKey(it.iitr.Key(), it.lastKey); it.iitr.Next() {
+			if utils.ParseTs(it.iitr.Key()) <= it.readTs {
+				vs = it.iitr.Value()
+				found = true
+				it.lastKey = utils.SafeCopy(it.lastKey, it.iitr.Key())
+				if it.opt.AllVersions {
+					it.versions = append(it.versions, it.newItem(it.lastKey, vs))
+				}
+			}
+		}
+		if it.opt.AllVersions {
+			if len(it.versions) > 0 {
+				return it.parseItemReverse()
+			}
+			continue
+		}
+		if !found || structs.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			continue
+		}
+		return it.newItem(it.lastKey, vs)
+	}
+	return nil
+}
+
+// newItem returns the item of the version key
+func (it *Iterator) newItem(key []byte, vs structs.ValueStruct) *Item {
+	item := &Item{
+		key:       utils.SafeCopy(nil, utils.ParseKey(key)),
+		vptr:      vs.Value,
+		version:   utils.ParseTs(key),
+		expiresAt: vs.ExpiresAt,
+		meta:      vs.Meta,
+		userMeta:  vs.UserMeta,
+		keysOnly:  it.opt.KeysOnly,
+		txn:       it.txn,
+	}
+	return item
+}
+
+// Close the iterator and release the memtables and tables, it waits for the values being fetched
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	if it.fetchCh != nil {
+		close(it.fetchCh)
+		it.fetchWg.Wait()
+	}
+	if err := it.iitr.Close(); err != nil {
+		it.txn.db.log.Errorf("while closing iterator: %v", err)
+	}
+	it.txn.numIterators.Add(-1)
+}
@@ -0,0 +1,382 @@
+package tiny_badger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/utils"
+)
+
+// iterateKeys returns the keys and values yielded by a fresh iterator of txn
+func iterateKeys(t *testing.T, it *Iterator) (keys, vals []string) {
+	for ; it.Valid(); it.Next() {
+		item := it.Item()
+		keys = append(keys, string(item.Key()))
+		vals = append(vals, string(getItemValue(t, item)))
+	}
+	return keys, vals
+}
+
+func TestIteratorMergeLevels(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	n := 10
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("v1"), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	// v1 lives in L1, v2 in L0 and v3 in the memtable
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.lc.doCompact(0))
+	for i := 0; i < n; i += 2 {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("v2"), 0x00)
+	}
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NotZero(t, db.lc.levels[0].numTables())
+	require.NotZero(t, db.lc.levels[1].numTables())
+
+	old := db.NewTransaction(true)
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key0"), []byte("v3")))
+	require.NoError(t, txn.Delete([]byte("key1")))
+	require.NoError(t, txn.Commit())
+
+	txn = db.NewTransaction(true)
+	it := txn.NewIterator(DefaultIteratorOptions)
+	it.Rewind()
+	keys, vals := iterateKeys(t, it)
+	require.Equal(t, []string{"key0", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}, keys)
+	require.Equal(t, []string{"v3", "v2", "v1", "v2", "v1", "v2", "v1", "v2", "v1"}, vals)
+
+	it.Seek([]byte("key45"))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("key5"), it.Item().Key())
+	it.Seek([]byte("key9a"))
+	require.False(t, it.Valid())
+	it.Close()
+	txn.Discard()
+
+	// the older snapshot doesn't see the latest writes
+	it = old.NewIterator(DefaultIteratorOptions)
+	it.Seek([]byte("key0"))
+	keys, vals = iterateKeys(t, it)
+	require.Len(t, keys, n)
+	require.Equal(t, "v2", vals[0])
+	require.Equal(t, "v1", vals[1])
+	it.Close()
+
+	// the newest visible version of every key is yielded in reverse order as well
+	it = old.NewIterator(IteratorOptions{Reverse: true})
+	it.Rewind()
+	keys, vals = iterateKeys(t, it)
+	require.Equal(t, []string{"key9", "key8", "key7", "key6", "key5", "key4", "key3", "key2", "key1", "key0"}, keys)
+	require.Equal(t, []string{"v1", "v2", "v1", "v2", "v1", "v2", "v1", "v2", "v1", "v2"}, vals)
+	it.Close()
+	old.Discard()
+
+	txn = db.NewTransaction(true)
+	it = txn.NewIterator(IteratorOptions{Reverse: true})
+	it.Seek([]byte("key2"))
+	keys, vals = iterateKeys(t, it)
+	require.Equal(t, []string{"key2", "key0"}, keys)
+	require.Equal(t, []string{"v2", "v3"}, vals)
+	it.Close()
+	txn.Discard()
+}
+
+func TestIteratorCorruptedBlock(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("v1"), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	// v1 lives in L1 and v2 in L0
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.lc.doCompact(0))
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("v2"), 0x00)
+	}
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+
+	// corrupt the only block of the L0 table
+	db.lc.levels[0].tables[0].Data[10] ^= 0xff
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	for _, opt := range []IteratorOptions{DefaultIteratorOptions, {Reverse: true}} {
+		it := txn.NewIterator(opt)
+		it.Rewind()
+		// the shadowed v1 must not be yielded
+		require.False(t, it.Valid())
+		require.ErrorContains(t, it.Error(), utils.ErrChecksumMismatch.Error())
+		it.Close()
+	}
+}
+
+func TestIteratorReadConflict(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("key"), []byte("val"), 0x00)
+
+		txn := db.NewTransaction(true)
+		it := txn.NewIterator(DefaultIteratorOptions)
+		for it.Rewind(); it.Valid(); it.Next() {
+			it.Item()
+		}
+		it.Close()
+		require.NoError(t, txn.Set([]byte("other"), []byte("val")))
+		txnSet(t, db, []byte("key"), []byte("val2"), 0x00)
+
+		// the iterated keys are tracked as reads
+		require.Equal(t, utils.ErrConflict, txn.Commit())
+	})
+}
+
+func TestIteratorPrefetchNoConflict(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0x00)
+		}
+
+		txn := db.NewTransaction(true)
+		it := txn.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		require.Equal(t, []byte("key0"), it.Item().Key())
+		// the later keys are prefetched but never reached
+		require.Len(t, it.data, 10)
+		it.Close()
+		require.NoError(t, txn.Set([]byte("other"), []byte("val")))
+		txnSet(t, db, []byte("key5"), []byte("val2"), 0x00)
+		require.NoError(t, txn.Commit())
+
+		// the key reached still conflicts
+		txn = db.NewTransaction(true)
+		it = txn.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		it.Item()
+		it.Close()
+		require.NoError(t, txn.Set([]byte("other"), []byte("val")))
+		txnSet(t, db, []byte("key0"), []byte("val2"), 0x00)
+		require.Equal(t, utils.ErrConflict, txn.Commit())
+	})
+}
+
+func TestIteratorUnclosed(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		it := txn.NewIterator(DefaultIteratorOptions)
+		require.Panics(t, txn.Discard)
+		it.Close()
+		txn.Discard()
+	})
+}
+
+func TestIteratorPrefixAndBounds(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, k := range []string{"a", "user:1/a", "user:1/b", "user:12/a", "user:2/a", "z"} {
+			txnSet(t, db, []byte(k), []byte(k), 0x00)
+		}
+		txnSet(t, db, []byte{0xff, 0xff, 0x01}, []byte("v"), 0x00)
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+
+		scan := func(opt IteratorOptions, seek string) []string {
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			if seek == "" {
+				it.Rewind()
+			} else {
+				it.Seek([]byte(seek))
+			}
+			keys, _ := iterateKeys(t, it)
+			return keys
+		}
+		require.Equal(t, []string{"user:1/a", "user:1/b"}, scan(IteratorOptions{Prefix: []byte("user:1/")}, ""))
+		require.Equal(t, []string{"user:1/b"}, scan(IteratorOptions{Prefix: []byte("user:1/")}, "user:1/aa"))
+		// seeking before the prefix starts from the prefix
+		require.Equal(t, []string{"user:1/a", "user:1/b"}, scan(IteratorOptions{Prefix: []byte("user:1/")}, "a"))
+		require.Equal(t, []string{"user:1/b", "user:12/a"},
+			scan(IteratorOptions{LowerBound: []byte("user:1/b"), UpperBound: []byte("user:2")}, ""))
+		require.Equal(t, []string{"user:12/a"},
+			scan(IteratorOptions{Prefix: []byte("user:1"), LowerBound: []byte("user:10")}, ""))
+		require.Equal(t, []string{"user:1/a"},
+			scan(IteratorOptions{Prefix: []byte("user:1"), UpperBound: []byte("user:1/b")}, ""))
+		require.Equal(t, []string{"\xff\xff\x01"}, scan(IteratorOptions{Prefix: []byte{0xff, 0xff}}, ""))
+		require.Empty(t, scan(IteratorOptions{Prefix: []byte("user:3")}, ""))
+
+		require.Equal(t, []string{"user:12/a", "user:1/b", "user:1/a"},
+			scan(IteratorOptions{Prefix: []byte("user:1"), Reverse: true}, ""))
+		require.Equal(t, []string{"user:1/b", "user:1/a"},
+			scan(IteratorOptions{Prefix: []byte("user:1"), Reverse: true}, "user:1/c"))
+		require.Equal(t, []string{"user:1/b"},
+			scan(IteratorOptions{LowerBound: []byte("user:1/b"), UpperBound: []byte("user:12/a"), Reverse: true}, ""))
+		require.Equal(t, []string{"z", "user:2/a"},
+			scan(IteratorOptions{LowerBound: []byte("user:2"), UpperBound: []byte("zz"), Reverse: true}, ""))
+		require.Equal(t, []string{"\xff\xff\x01", "z"},
+			scan(IteratorOptions{LowerBound: []byte("z"), Reverse: true}, ""))
+	})
+}
+
+func TestIteratorPickTable(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	// every reopen flushes a memtable into an L0 table
+	for _, prefix := range []string{"a", "b", "c"} {
+		db, err := Open(opts)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("%s%d", prefix, i)), []byte("val"), 0x00)
+		}
+		require.NoError(t, db.Close())
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, 3, db.lc.levels[0].numTables())
+
+	numIters := func(opt IteratorOptions) int {
+		iters := db.lc.appendIterators(nil, &opt)
+		for _, it := range iters {
+			require.NoError(t, it.Close())
+		}
+		return len(iters)
+	}
+	require.Equal(t, 1, numIters(IteratorOptions{Prefix: []byte("b")}))
+	require.Equal(t, 1, numIters(IteratorOptions{LowerBound: []byte("a5"), UpperBound: []byte("b")}))
+	require.Equal(t, 2, numIters(IteratorOptions{LowerBound: []byte("b5")}))
+	require.Equal(t, 3, numIters(DefaultIteratorOptions))
+}
+
+func TestIteratorAllVersions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a"), []byte("v1"), 0x00)
+		txnSet(t, db, []byte("a"), []byte("v2"), 0x00)
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Delete([]byte("a")))
+		require.NoError(t, txn.Commit())
+		txnSet(t, db, []byte("a"), []byte("v4"), 0x00)
+		txnSet(t, db, []byte("b"), []byte("v5"), 0x00)
+
+		type version struct {
+			key     string
+			ts      uint64
+			deleted bool
+		}
+		scan := func(txn *Txn, reverse bool) []version {
+			it := txn.NewIterator(IteratorOptions{AllVersions: true, Reverse: reverse})
+			defer it.Close()
+			var versions []version
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				versions = append(versions, version{string(item.Key()), item.Version(), item.IsDeletedOrExpired()})
+			}
+			return versions
+		}
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		a := []version{{"a", 4, false}, {"a", 3, true}, {"a", 2, false}, {"a", 1, false}}
+		require.Equal(t, append(a, version{"b", 5, false}), scan(txn, false))
+		require.Equal(t, append([]version{{"b", 5, false}}, a...), scan(txn, true))
+
+		// time travel to the snapshot before the delete
+		old := db.NewTransactionAt(2, false)
+		defer old.Discard()
+		require.Equal(t, a[2:], scan(old, false))
+		require.Equal(t, a[2:], scan(old, true))
+		item, err := old.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v2"), getItemValue(t, item))
+		it := old.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		keys, vals := iterateKeys(t, it)
+		it.Close()
+		require.Equal(t, []string{"a"}, keys)
+		require.Equal(t, []string{"v2"}, vals)
+		require.Equal(t, utils.ErrReadOnlyTxn, old.Set([]byte("a"), []byte("v")))
+	})
+}
+
+func TestIteratorPrefetchValues(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.ValueThreshold = 32
+	opts.ValueLogFileSize = 4 << 10
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		n := 300
+		for i := 0; i < n; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), largeValue(i), 0x00)
+		}
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for _, opt := range []IteratorOptions{
+			{PrefetchValues: true, PrefetchSize: 10},
+			{PrefetchValues: true, PrefetchSize: 1000, Reverse: true},
+			{PrefetchValues: false},
+		} {
+			it := txn.NewIterator(opt)
+			var i int
+			for it.Rewind(); it.Valid(); it.Next() {
+				idx := i
+				if opt.Reverse {
+					idx = n - 1 - i
+				}
+				require.Equal(t, []byte(fmt.Sprintf("key%05d", idx)), it.Item().Key())
+				require.Equal(t, largeValue(idx), getItemValue(t, it.Item()))
+				i++
+			}
+			require.Equal(t, n, i)
+
+			// seek drops the items parsed ahead
+			it.Seek([]byte("key00150"))
+			require.True(t, it.Valid())
+			require.Equal(t, largeValue(150), getItemValue(t, it.Item()))
+			it.Close()
+		}
+
+		// keys only iteration never reads the values
+		it := txn.NewIterator(IteratorOptions{KeysOnly: true, PrefetchValues: true, PrefetchSize: 10})
+		defer it.Close()
+		var i int
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			require.Equal(t, []byte(fmt.Sprintf("key%05d", i)), item.Key())
+			require.Greater(t, item.EstimatedSize(), int64(len(largeValue(i))))
+			_, err := item.ValueCopy(nil)
+			require.Equal(t, utils.ErrKeysOnly, err)
+			i++
+		}
+		require.Equal(t, n, i)
+	})
+}
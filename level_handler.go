@@ -1,11 +1,265 @@
 package tiny_badger
 
-import "tiny-badger/structs"
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"tiny-badger/structs"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
 
 type levelHandler struct {
-	level int
+	sync.RWMutex // guards tables
+
+	// L0 tables are sorted by file id, they may overlap with each other.
+	// L1+ tables are sorted by key range, and they never overlap.
+	level  int
+	tables []*table.Table
+	db     *DB
+}
+
+func newLevelHandler(db *DB, level int) *levelHandler {
+	return &levelHandler{
+		level: level,
+		db:    db,
+	}
+}
+
+// initTables replaces the tables of the level and sorts them
+func (s *levelHandler) initTables(tables []*table.Table) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tables = tables
+	s.sortTables()
+}
+
+// sortTables should be called with lock held
+func (s *levelHandler) sortTables() {
+	if s.level == 0 {
+		sort.Slice(s.tables, func(i, j int) bool {
+			return s.tables[i].ID() < s.tables[j].ID()
+		})
+		return
+	}
+	sort.Slice(s.tables, func(i, j int) bool {
+		return utils.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+	})
+}
+
+// addTable appends a table to the level, L0 tables are appended in flush order
+func (s *levelHandler) addTable(t *table.Table) {
+	s.Lock()
+	defer s.Unlock()
+	s.tables = append(s.tables, t)
+}
+
+// tryAddLevel0Table appends a table to L0 unless L0 has too many tables
+func (s *levelHandler) tryAddLevel0Table(t *table.Table) bool {
+	utils.AssertTrue(s.level == 0)
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.tables) >= s.db.opts.NumLevelZeroTablesStall {
+		return false
+	}
+	s.tables = append(s.tables, t)
+	return true
+}
+
+// replaceTables removes toDel and adds toAdd, the removed tables are released
+func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
+	s.Lock()
+
+	toDelMap := make(map[uint64]struct{}, len(toDel))
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
+	}
+	var newTables []*table.Table
+	for _, t := range s.tables {
+		if _, ok := toDelMap[t.ID()]; !ok {
+			newTables = append(newTables, t)
+		}
+	}
+	s.tables = append(newTables, toAdd...)
+	s.sortTables()
+	s.Unlock()
+
+	return decrRefs(toDel)
+}
+
+// deleteTables removes toDel from the level, the removed tables are released
+func (s *levelHandler) deleteTables(toDel []*table.Table) error {
+	return s.replaceTables(toDel, nil)
+}
+
+func (s *levelHandler) numTables() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.tables)
+}
+
+// totalSize of the table files in this level
+func (s *levelHandler) totalSize() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	var sz int64
+	for _, t := range s.tables {
+		sz += t.Size()
+	}
+	return sz
+}
+
+// overlappingTables returns the tables overlap with the key range, should be called with lock held
+func (s *levelHandler) overlappingTables(kr keyRange) []*table.Table {
+	var out []*table.Table
+	for _, t := range s.tables {
+		if kr.overlapsWith(getKeyRange(t)) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// getTablesForKey returns the tables which may contain the key, newest first for L0.
+// The tables are referenced until the returned function is called.
+func (s *levelHandler) getTablesForKey(key []byte) ([]*table.Table, func() error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	userKey := utils.ParseKey(key)
+	var tables []*table.Table
+	if s.level == 0 {
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			t := s.tables[i]
+			if keyInRange(userKey, t.Smallest(), t.Biggest()) {
+				tables = append(tables, t)
+			}
+		}
+	} else {
+		// the first table whose biggest key >= key
+		idx := sort.Search(len(s.tables), func(i int) bool {
+			return bytes.Compare(utils.ParseKey(s.tables[i].Biggest()), userKey) >= 0
+		})
+		if idx < len(s.tables) && keyInRange(userKey, s.tables[idx].Smallest(), s.tables[idx].Biggest()) {
+			tables = append(tables, s.tables[idx])
+		}
+	}
+
+	for _, t := range tables {
+		t.IncrRef()
+	}
+	return tables, func() error {
+		return decrRefs(tables)
+	}
+}
+
+func decrRefs(tables []*table.Table) error {
+	var err error
+	for _, t := range tables {
+		err = utils.CombineErrors(err, t.DecrRef())
+	}
+	return err
+}
+
+// keyInRange checks whether the user key is in the key range of a table
+func keyInRange(userKey, smallest, biggest []byte) bool {
+	return bytes.Compare(userKey, utils.ParseKey(smallest)) >= 0 &&
+		bytes.Compare(userKey, utils.ParseKey(biggest)) <= 0
 }
 
+// get returns the value of key with the highest version among the tables of this level
 func (s *levelHandler) get(key []byte) (structs.ValueStruct, error) {
-	return structs.ValueStruct{}, nil
+	tables, decr := s.getTablesForKey(key)
+	defer func() {
+		if err := decr(); err != nil {
+			s.db.log.Errorf("while releasing tables: %v", err)
+		}
+	}()
+
+	var maxVs structs.ValueStruct
+	version := utils.ParseTs(key)
+	for _, t := range tables {
+		vs, err := getFromTable(t, key)
+		if err != nil {
+			return structs.ValueStruct{}, utils.Wrapf(err, "get key from table %d", t.ID())
+		}
+		if vs.Value == nil && vs.Meta == 0 {
+			continue
+		}
+		// found the value from the newest table
+		if vs.Version == version {
+			return vs, nil
+		}
+		if maxVs.Version < vs.Version {
+			maxVs = vs
+		}
+	}
+	return maxVs, nil
+}
+
+// getFromTable seeks the key in table, the value is copied out since the table may be deleted
+func getFromTable(t *table.Table, key []byte) (structs.ValueStruct, error) {
+	it := t.NewIterator()
+	defer it.Close()
+
+	it.Seek(key)
+	if !it.Valid() {
+		return structs.ValueStruct{}, it.Error()
+	}
+	if !utils.SameKey(key, it.Key()) {
+		return structs.ValueStruct{}, nil
+	}
+	vs := it.Value()
+	// keep the empty value non-nil, so it's not taken as a missing key
+	val := make([]byte, len(vs.Value))
+	copy(val, vs.Value)
+	vs.Value = val
+	return vs, nil
+}
+
+// appendIterators appends the iterators of the tables picked by opt to iters, L0 tables are
+// appended newest first
+func (s *levelHandler) appendIterators(iters []table.Iterator, opt *IteratorOptions) []table.Iterator {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.level == 0 {
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			if !opt.pickTable(s.tables[i]) {
+				continue
+			}
+			if opt.Reverse {
+				iters = append(iters, s.tables[i].NewReverseIterator())
+			} else {
+				iters = append(iters, s.tables[i].NewIterator())
+			}
+		}
+		return iters
+	}
+	// the tables picked are still sorted and don't overlap
+	var tables []*table.Table
+	for _, t := range s.tables {
+		if opt.pickTable(t) {
+			tables = append(tables, t)
+		}
+	}
+	if len(tables) == 0 {
+		return iters
+	}
+	return append(iters, table.NewConcatIterator(tables, opt.Reverse))
+}
+
+// close the tables without removing their files
+func (s *levelHandler) close() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	var err error
+	for _, t := range s.tables {
+		err = utils.CombineErrors(err, t.Close())
+	}
+	return utils.Wrapf(err, "levelHandler.close")
 }
@@ -0,0 +1,76 @@
+package tiny_badger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+// buildTestTable creates an in-memory table with keys in [start, end) and the value suffix
+func buildTestTable(t *testing.T, id uint64, start, end int, suffix string) *table.Table {
+	b := table.NewTableBuilder(config.DefaultOptions(""))
+	for i := start; i < end; i++ {
+		b.Add(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			structs.ValueStruct{Value: []byte(fmt.Sprintf("%05d%s", i, suffix))})
+	}
+	tbl, err := table.OpenInMemoryTable(b.Finish(), id)
+	require.NoError(t, err)
+	return tbl
+}
+
+func TestLevelHandlerGetL0(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		s := newLevelHandler(db, 0)
+		// the newer table overlaps with the older one
+		s.initTables([]*table.Table{
+			buildTestTable(t, 2, 50, 150, "new"),
+			buildTestTable(t, 1, 0, 100, "old"),
+		})
+		require.Equal(t, uint64(1), s.tables[0].ID())
+
+		vs, err := s.get(utils.KeyWithTs([]byte("00010"), 0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("00010old"), vs.Value)
+
+		vs, err = s.get(utils.KeyWithTs([]byte("00060"), 0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("00060new"), vs.Value)
+
+		vs, err = s.get(utils.KeyWithTs([]byte("00200"), 0))
+		require.NoError(t, err)
+		require.Nil(t, vs.Value)
+	})
+}
+
+func TestLevelHandlerGetL1(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		s := newLevelHandler(db, 1)
+		s.initTables([]*table.Table{
+			buildTestTable(t, 3, 200, 300, "c"),
+			buildTestTable(t, 1, 0, 100, "a"),
+			buildTestTable(t, 2, 100, 150, "b"),
+		})
+		require.Equal(t, uint64(1), s.tables[0].ID())
+		require.Equal(t, uint64(2), s.tables[1].ID())
+		require.Equal(t, uint64(3), s.tables[2].ID())
+
+		for i, suffix := range map[int]string{0: "a", 99: "a", 100: "b", 149: "b", 200: "c", 299: "c"} {
+			vs, err := s.get(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("%05d%s", i, suffix)), vs.Value)
+		}
+
+		// falls in the gap between tables
+		tables, decr := s.getTablesForKey(utils.KeyWithTs([]byte("00170"), 0))
+		require.Empty(t, tables)
+		require.NoError(t, decr())
+
+		vs, err := s.get(utils.KeyWithTs([]byte("00300"), 0))
+		require.NoError(t, err)
+		require.Nil(t, vs.Value)
+	})
+}
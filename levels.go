@@ -1,14 +1,125 @@
 package tiny_badger
 
 import (
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/pkg/errors"
+	"os"
+	"sync/atomic"
+	"time"
 	"tiny-badger/structs"
+	"tiny-badger/table"
 	"tiny-badger/utils"
 )
 
 type levelsController struct {
+	nextFileID atomic.Uint64
+
 	db *DB
 
-	levels []*levelHandler
+	levels  []*levelHandler
+	cstatus compactStatus
+}
+
+func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
+	lc := &levelsController{
+		db:     db,
+		levels: make([]*levelHandler, db.opts.MaxLevels),
+	}
+	lc.cstatus.busy = make([]bool, db.opts.MaxLevels)
+	for i := range lc.levels {
+		lc.levels[i] = newLevelHandler(db, i)
+	}
+	if db.opts.InMemory {
+		return lc, nil
+	}
+
+	files, err := os.ReadDir(db.opts.Dir)
+	if err != nil {
+		return nil, utils.Wrapf(err, "open dir %s for tables", db.opts.Dir)
+	}
+	idMap := make(map[uint64]struct{})
+	for _, file := range files {
+		if id, ok := table.ParseFileID(file.Name()); ok {
+			idMap[id] = struct{}{}
+		}
+	}
+	// remove the tables which were not recorded in manifest, e.g. crashed during compaction
+	if err := revertToManifest(db.opts.Dir, mf, idMap, db.opts.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	var maxFileID uint64
+	tables := make([][]*table.Table, db.opts.MaxLevels)
+	for id, tm := range mf.Tables {
+		if tm.Level >= db.opts.MaxLevels {
+			closeAllTables(tables)
+			return nil, errors.Errorf("table %d at level %d exceeds MaxLevels %d", id, tm.Level, db.opts.MaxLevels)
+		}
+		t, err := lc.openTable(id)
+		if err != nil {
+			closeAllTables(tables)
+			return nil, err
+		}
+		tables[tm.Level] = append(tables[tm.Level], t)
+		if id > maxFileID {
+			maxFileID = id
+		}
+	}
+	for i, l := range lc.levels {
+		l.initTables(tables[i])
+	}
+	lc.nextFileID.Store(maxFileID)
+	return lc, nil
+}
+
+func closeAllTables(tables [][]*table.Table) {
+	for _, level := range tables {
+		for _, t := range level {
+			_ = t.Close()
+		}
+	}
+}
+
+func (lc *levelsController) openTable(id uint64) (*table.Table, error) {
+	flags := os.O_RDWR
+	if lc.db.opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	path := table.NewFilename(id, lc.db.opts.Dir)
+	mf, err := z.OpenMmapFile(path, flags, 0)
+	if err != nil {
+		return nil, utils.Wrapf(err, "while opening table: %s", path)
+	}
+	t, err := table.OpenTable(mf)
+	return t, utils.Wrapf(err, "while opening table: %s", path)
+}
+
+func (lc *levelsController) reserveFileID() uint64 {
+	return lc.nextFileID.Add(1)
+}
+
+// createTable writes the builder to a new table file, or keeps it in memory for in-memory mode
+func (lc *levelsController) createTable(b *table.Builder) (*table.Table, error) {
+	fileID := lc.reserveFileID()
+	if lc.db.opts.InMemory {
+		return table.OpenInMemoryTable(b.Finish(), fileID)
+	}
+	return table.CreateTable(table.NewFilename(fileID, lc.db.opts.Dir), b)
+}
+
+// addLevel0Table records the table in manifest, and blocks until the compactors make room for it in L0
+func (lc *levelsController) addLevel0Table(t *table.Table) error {
+	if err := lc.db.manifest.addChanges([]manifestChange{newCreateChange(t.ID(), 0)}); err != nil {
+		return utils.Wrapf(err, "while adding table %d to manifest", t.ID())
+	}
+	if lc.db.opts.NumCompactors == 0 {
+		lc.levels[0].addTable(t)
+		return nil
+	}
+	for !lc.levels[0].tryAddLevel0Table(t) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
 }
 
 func (lc *levelsController) Get(key []byte, maxVs structs.ValueStruct, startLevel int) (structs.ValueStruct, error) {
@@ -37,3 +148,34 @@ func (lc *levelsController) Get(key []byte, maxVs structs.ValueStruct, startLeve
 	}
 	return maxVs, nil
 }
+
+// appendIterators appends the iterators of all the levels from top to bottom
+func (lc *levelsController) appendIterators(iters []table.Iterator, opt *IteratorOptions) []table.Iterator {
+	for _, l := range lc.levels {
+		iters = l.appendIterators(iters, opt)
+	}
+	return iters
+}
+
+// maxVersion returns the max version of all the tables
+func (lc *levelsController) maxVersion() uint64 {
+	var maxVersion uint64
+	for _, l := range lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if t.MaxVersion() > maxVersion {
+				maxVersion = t.MaxVersion()
+			}
+		}
+		l.RUnlock()
+	}
+	return maxVersion
+}
+
+func (lc *levelsController) close() error {
+	var err error
+	for _, l := range lc.levels {
+		err = utils.CombineErrors(err, l.close())
+	}
+	return utils.Wrapf(err, "levelsController.close")
+}
@@ -0,0 +1,401 @@
+package tiny_badger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+const (
+	ManifestFilename                  = "MANIFEST"
+	manifestRewriteFilename           = "MANIFEST-REWRITE"
+	manifestDeletionsRewriteThreshold = 10000
+	manifestDeletionsRatio            = 10
+
+	manifestMagic   uint32 = 0x6d616e69
+	manifestVersion uint32 = 1
+
+	// change: | op(1 byte) | table id(8 bytes) | level(4 bytes) |
+	manifestChangeSize = 13
+)
+
+type manifestOp byte
+
+const (
+	manifestCreate manifestOp = iota
+	manifestDelete
+)
+
+// manifestChange creates or deletes a table at a level
+type manifestChange struct {
+	op    manifestOp
+	id    uint64
+	level int
+}
+
+func newCreateChange(id uint64, level int) manifestChange {
+	return manifestChange{op: manifestCreate, id: id, level: level}
+}
+
+func newDeleteChange(id uint64) manifestChange {
+	return manifestChange{op: manifestDelete, id: id}
+}
+
+// Manifest records the level of every table, it's rebuilt by replaying the change sets in MANIFEST
+type Manifest struct {
+	Levels []levelManifest
+	Tables map[uint64]tableManifest
+
+	// used to decide when to rewrite the MANIFEST file
+	Creations int
+	Deletions int
+}
+
+type levelManifest struct {
+	Tables map[uint64]struct{}
+}
+
+type tableManifest struct {
+	Level int
+}
+
+func createManifest() Manifest {
+	return Manifest{
+		Tables: make(map[uint64]tableManifest),
+	}
+}
+
+// asChanges returns the change set which creates all the tables of the manifest
+func (m *Manifest) asChanges() []manifestChange {
+	changes := make([]manifestChange, 0, len(m.Tables))
+	for id, tm := range m.Tables {
+		changes = append(changes, newCreateChange(id, tm.Level))
+	}
+	return changes
+}
+
+func (m *Manifest) clone() Manifest {
+	mf := createManifest()
+	utils.Check(applyChangeSet(&mf, m.asChanges()))
+	mf.Creations, mf.Deletions = m.Creations, m.Deletions
+	return mf
+}
+
+// manifestFile is the append-only log of change sets
+// layout of MANIFEST
+// +---------------+-----------------+------------+-----+------------+
+// | magic(4 bytes)| version(4 bytes)| change set | ... | change set |
+// +---------------+-----------------+------------+-----+------------+
+// change set: | len(4 bytes) | crc32(4 bytes) | change | ... | change |
+type manifestFile struct {
+	fp        *os.File
+	directory string
+
+	// guards appending change sets and the in-memory manifest
+	appendLock sync.Mutex
+	manifest   Manifest
+
+	deletionsRewriteThreshold int
+}
+
+// openOrCreateManifestFile replays the MANIFEST in dir, a new one is created if it doesn't exist
+func openOrCreateManifestFile(dir string, readOnly bool) (*manifestFile, Manifest, error) {
+	return helpOpenOrCreateManifestFile(dir, readOnly, manifestDeletionsRewriteThreshold)
+}
+
+func helpOpenOrCreateManifestFile(dir string, readOnly bool, deletionsThreshold int) (*manifestFile, Manifest, error) {
+	path := filepath.Join(dir, ManifestFilename)
+	var flags = os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, Manifest{}, utils.Wrapf(err, "while opening %s", path)
+		}
+		if readOnly {
+			return nil, Manifest{}, errors.Errorf("no manifest found, required for read-only db")
+		}
+		m := createManifest()
+		fp, err = helpRewrite(dir, &m)
+		if err != nil {
+			return nil, Manifest{}, err
+		}
+		mf := &manifestFile{
+			fp:                        fp,
+			directory:                 dir,
+			manifest:                  m.clone(),
+			deletionsRewriteThreshold: deletionsThreshold,
+		}
+		return mf, m, nil
+	}
+
+	m, truncOffset, err := ReplayManifestFile(fp)
+	if err != nil {
+		_ = fp.Close()
+		return nil, Manifest{}, err
+	}
+	if !readOnly {
+		// drop the torn change set at the end
+		if err := fp.Truncate(truncOffset); err != nil {
+			_ = fp.Close()
+			return nil, Manifest{}, utils.Wrapf(err, "while truncating %s", path)
+		}
+	}
+	if _, err = fp.Seek(0, io.SeekEnd); err != nil {
+		_ = fp.Close()
+		return nil, Manifest{}, utils.Wrapf(err, "while seeking to the end of %s", path)
+	}
+
+	mf := &manifestFile{
+		fp:                        fp,
+		directory:                 dir,
+		manifest:                  m.clone(),
+		deletionsRewriteThreshold: deletionsThreshold,
+	}
+	return mf, m, nil
+}
+
+func (mf *manifestFile) close() error {
+	if mf == nil {
+		return nil
+	}
+	return mf.fp.Close()
+}
+
+// addChanges appends a change set and syncs the file, the MANIFEST is rewritten if there are too many deletions
+func (mf *manifestFile) addChanges(changes []manifestChange) error {
+	if mf == nil {
+		// in-memory mode
+		return nil
+	}
+	buf := encodeChangeSet(changes)
+
+	mf.appendLock.Lock()
+	defer mf.appendLock.Unlock()
+	if err := applyChangeSet(&mf.manifest, changes); err != nil {
+		return err
+	}
+
+	if mf.manifest.Deletions > mf.deletionsRewriteThreshold &&
+		mf.manifest.Deletions > manifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) {
+		return mf.rewrite()
+	}
+	if _, err := mf.fp.Write(buf); err != nil {
+		return utils.Wrapf(err, "while writing manifest")
+	}
+	return mf.fp.Sync()
+}
+
+// rewrite compacts the MANIFEST to the creations of the live tables, should be called with appendLock held
+func (mf *manifestFile) rewrite() error {
+	if err := mf.fp.Close(); err != nil {
+		return err
+	}
+	fp, err := helpRewrite(mf.directory, &mf.manifest)
+	if err != nil {
+		return err
+	}
+	mf.fp = fp
+	mf.manifest.Creations = len(mf.manifest.Tables)
+	mf.manifest.Deletions = 0
+	return nil
+}
+
+// helpRewrite writes the manifest to MANIFEST-REWRITE and renames it to MANIFEST
+func helpRewrite(dir string, m *Manifest) (*os.File, error) {
+	rewritePath := filepath.Join(dir, manifestRewriteFilename)
+	fp, err := os.OpenFile(rewritePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, utils.Wrapf(err, "while creating %s", rewritePath)
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], manifestMagic)
+	binary.BigEndian.PutUint32(header[4:8], manifestVersion)
+	buf := append(header[:], encodeChangeSet(m.asChanges())...)
+	if _, err := fp.Write(buf); err != nil {
+		_ = fp.Close()
+		return nil, utils.Wrapf(err, "while writing %s", rewritePath)
+	}
+	if err := fp.Sync(); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	if err := fp.Close(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, ManifestFilename)
+	if err := os.Rename(rewritePath, path); err != nil {
+		return nil, utils.Wrapf(err, "while renaming %s", rewritePath)
+	}
+	fp, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	if err := z.SyncDir(dir); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// ReplayManifestFile rebuilds the manifest from fp, returns the offset after the last valid change set
+func ReplayManifestFile(fp *os.File) (Manifest, int64, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return Manifest{}, 0, utils.Wrapf(err, "while stating manifest")
+	}
+	size := fi.Size()
+	r := bufio.NewReader(fp)
+
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Manifest{}, 0, utils.Wrapf(err, "while reading manifest header")
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != manifestMagic {
+		return Manifest{}, 0, errors.New("manifest has bad magic")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != manifestVersion {
+		return Manifest{}, 0, errors.Errorf("manifest has unsupported version: %d", version)
+	}
+
+	m := createManifest()
+	offset := int64(len(header))
+	for {
+		var lenCrc [8]byte
+		if _, err := io.ReadFull(r, lenCrc[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return Manifest{}, 0, err
+		}
+		length := binary.BigEndian.Uint32(lenCrc[0:4])
+		if int64(length) > size-offset-int64(len(lenCrc)) {
+			// the length of a torn change set may be garbage, don't allocate for it
+			break
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return Manifest{}, 0, err
+		}
+		if crc32.Checksum(buf, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrc[4:8]) {
+			// the change set is torn
+			break
+		}
+
+		changes, err := decodeChanges(buf)
+		if err != nil {
+			return Manifest{}, 0, err
+		}
+		if err := applyChangeSet(&m, changes); err != nil {
+			return Manifest{}, 0, err
+		}
+		offset += int64(len(lenCrc)) + int64(length)
+	}
+	return m, offset, nil
+}
+
+func encodeChangeSet(changes []manifestChange) []byte {
+	buf := make([]byte, 8+len(changes)*manifestChangeSize)
+	data := buf[8:]
+	for i, c := range changes {
+		b := data[i*manifestChangeSize:]
+		b[0] = byte(c.op)
+		binary.BigEndian.PutUint64(b[1:9], c.id)
+		binary.BigEndian.PutUint32(b[9:13], uint32(c.level))
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, utils.CastagnoliCrcTable))
+	return buf
+}
+
+func decodeChanges(buf []byte) ([]manifestChange, error) {
+	if len(buf)%manifestChangeSize != 0 {
+		return nil, errors.Errorf("invalid manifest change set size: %d", len(buf))
+	}
+	changes := make([]manifestChange, 0, len(buf)/manifestChangeSize)
+	for data := buf; len(data) > 0; data = data[manifestChangeSize:] {
+		changes = append(changes, manifestChange{
+			op:    manifestOp(data[0]),
+			id:    binary.BigEndian.Uint64(data[1:9]),
+			level: int(binary.BigEndian.Uint32(data[9:13])),
+		})
+	}
+	return changes, nil
+}
+
+func applyChangeSet(m *Manifest, changes []manifestChange) error {
+	for _, c := range changes {
+		if err := applyManifestChange(m, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyManifestChange(m *Manifest, c manifestChange) error {
+	switch c.op {
+	case manifestCreate:
+		if _, ok := m.Tables[c.id]; ok {
+			return fmt.Errorf("MANIFEST invalid, table %d exists", c.id)
+		}
+		m.Tables[c.id] = tableManifest{Level: c.level}
+		for len(m.Levels) <= c.level {
+			m.Levels = append(m.Levels, levelManifest{Tables: make(map[uint64]struct{})})
+		}
+		m.Levels[c.level].Tables[c.id] = struct{}{}
+		m.Creations++
+	case manifestDelete:
+		tm, ok := m.Tables[c.id]
+		if !ok {
+			return fmt.Errorf("MANIFEST removes non-existing table %d", c.id)
+		}
+		delete(m.Levels[tm.Level].Tables, c.id)
+		delete(m.Tables, c.id)
+		m.Deletions++
+	default:
+		return fmt.Errorf("MANIFEST file has invalid change op: %d", c.op)
+	}
+	return nil
+}
+
+// revertToManifest removes the table files which are not in the manifest, and checks all the tables exist
+func revertToManifest(dir string, m *Manifest, idMap map[uint64]struct{}, readOnly bool) error {
+	for id := range m.Tables {
+		if _, ok := idMap[id]; !ok {
+			return fmt.Errorf("file does not exist for table %d", id)
+		}
+	}
+	for id := range idMap {
+		if _, ok := m.Tables[id]; ok {
+			continue
+		}
+		if readOnly {
+			continue
+		}
+		path := table.NewFilename(id, dir)
+		if err := os.Remove(path); err != nil {
+			return utils.Wrapf(err, "while removing orphaned table %s", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package tiny_badger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tiny-badger/config"
+	"tiny-badger/table"
+	"tiny-badger/utils"
+)
+
+func TestManifestReplay(t *testing.T) {
+	dir := utils.CreateTmpDir("manifest-test")
+	defer utils.DestroyDir(dir)
+
+	mf, m, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	require.Empty(t, m.Tables)
+
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(1, 0), newCreateChange(2, 0)}))
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(3, 1), newDeleteChange(1), newDeleteChange(2)}))
+	require.NoError(t, mf.addChanges([]manifestChange{newDeleteChange(3), newCreateChange(3, 2)}))
+	require.Error(t, mf.addChanges([]manifestChange{newDeleteChange(4)}))
+	require.NoError(t, mf.close())
+
+	mf, m, err = openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	defer mf.close()
+	require.Equal(t, map[uint64]tableManifest{3: {Level: 2}}, m.Tables)
+	require.Empty(t, m.Levels[0].Tables)
+	require.Empty(t, m.Levels[1].Tables)
+	require.Len(t, m.Levels[2].Tables, 1)
+	require.Equal(t, 4, m.Creations)
+	require.Equal(t, 3, m.Deletions)
+}
+
+func TestManifestTornChangeSet(t *testing.T) {
+	dir := utils.CreateTmpDir("manifest-test")
+	defer utils.DestroyDir(dir)
+
+	mf, _, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(1, 0)}))
+	fi, err := mf.fp.Stat()
+	require.NoError(t, err)
+	validSize := fi.Size()
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(2, 0)}))
+	require.NoError(t, mf.close())
+
+	// tear the last change set
+	path := filepath.Join(dir, ManifestFilename)
+	require.NoError(t, os.Truncate(path, validSize+10))
+
+	mf, m, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	defer mf.close()
+	require.Equal(t, map[uint64]tableManifest{1: {Level: 0}}, m.Tables)
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, validSize, fi.Size())
+}
+
+func TestManifestTornLength(t *testing.T) {
+	dir := utils.CreateTmpDir("manifest-test")
+	defer utils.DestroyDir(dir)
+
+	mf, _, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(1, 0)}))
+	fi, err := mf.fp.Stat()
+	require.NoError(t, err)
+	validSize := fi.Size()
+	require.NoError(t, mf.close())
+
+	// append a change set whose length is far beyond the file
+	path := filepath.Join(dir, ManifestFilename)
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = fp.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	mf, m, err := openOrCreateManifestFile(dir, false)
+	require.NoError(t, err)
+	defer mf.close()
+	require.Equal(t, map[uint64]tableManifest{1: {Level: 0}}, m.Tables)
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, validSize, fi.Size())
+}
+
+func TestManifestRewrite(t *testing.T) {
+	dir := utils.CreateTmpDir("manifest-test")
+	defer utils.DestroyDir(dir)
+
+	deletionsThreshold := 10
+	mf, _, err := helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(0, 0)}))
+	for i := uint64(0); i < uint64(deletionsThreshold*3); i++ {
+		require.NoError(t, mf.addChanges([]manifestChange{newCreateChange(i+1, 0), newDeleteChange(i)}))
+	}
+	require.Less(t, mf.manifest.Deletions, deletionsThreshold*3)
+	require.NoError(t, mf.close())
+
+	mf, m, err := helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	require.NoError(t, err)
+	defer mf.close()
+	require.Equal(t, map[uint64]tableManifest{uint64(deletionsThreshold * 3): {Level: 0}}, m.Tables)
+}
+
+func TestManifestRestoresLevels(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.MemtableSize = 64 << 10
+	opts.BaseTableSize = 32 << 10
+	opts.BaseLevelSize = 128 << 10
+	opts.NumLevelZeroTables = 2
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), newValue(i), 0x00)
+	}
+	require.Eventually(t, func() bool {
+		return len(db.lc.pickCompactLevels()) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Close())
+
+	getLevels := func(db *DB) [][]uint64 {
+		var levels [][]uint64
+		for _, l := range db.lc.levels {
+			var ids []uint64
+			for _, t := range l.tables {
+				ids = append(ids, t.ID())
+			}
+			levels = append(levels, ids)
+		}
+		return levels
+	}
+	// the levels are restored without compaction
+	opts.NumCompactors = 0
+	db, err = Open(opts)
+	require.NoError(t, err)
+	levels := getLevels(db)
+	var below int
+	for _, ids := range levels[1:] {
+		below += len(ids)
+	}
+	require.Greater(t, below, 0)
+
+	txn := db.NewTransaction(true)
+	for i := 0; i < n; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+		require.Equal(t, newValue(i), getItemValue(t, item))
+	}
+	txn.Discard()
+	require.NoError(t, db.Close())
+
+	// the orphaned table is removed
+	orphan := table.NewFilename(db.lc.nextFileID.Load()+1, dir)
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0666))
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, levels, getLevels(db))
+	_, err = os.Stat(orphan)
+	require.True(t, os.IsNotExist(err))
+}
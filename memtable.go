@@ -108,9 +108,8 @@ func (db *DB) openMemTable(fid int, flags int) (*MemTable, error) {
 		return mt, err
 	}
 
-	// todo update skiplist
-
-	return mt, nil
+	err = mt.UpdateSkipList()
+	return mt, utils.Wrapf(err, "while updating skiplist")
 }
 
 func (db *DB) newMemTable() (*MemTable, error) {
@@ -153,6 +152,37 @@ func (mt *MemTable) Put(key []byte, value structs.ValueStruct) error {
 	return nil
 }
 
+// UpdateSkipList replays the WAL to rebuild the skiplist, the file is truncated at the first torn record
+func (mt *MemTable) UpdateSkipList() error {
+	if mt.wal == nil || mt.skl == nil {
+		return nil
+	}
+	endOff, err := mt.wal.Iterate(0, mt.replayFunction())
+	if err != nil {
+		return utils.Wrapf(err, "while iterating wal: %s", mt.wal.Fd.Name())
+	}
+	if mt.opts.ReadOnly {
+		// can't truncate the file in read only mode, the records after endOff are ignored
+		return nil
+	}
+	return mt.wal.Truncate(int64(endOff))
+}
+
+func (mt *MemTable) replayFunction() storage.LogEntryFunc {
+	return func(e *structs.Entry, _ structs.ValuePointer) error {
+		if ts := utils.ParseTs(e.Key); ts > mt.maxVersion {
+			mt.maxVersion = ts
+		}
+		mt.skl.Put(e.Key, structs.ValueStruct{
+			Value:     e.Value,
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+			UserMeta:  e.UserMeta,
+		})
+		return nil
+	}
+}
+
 func (mt *MemTable) IncrRef() {
 	mt.skl.IncrRef()
 }
@@ -162,11 +192,22 @@ func (mt *MemTable) DecrRef() {
 }
 
 func (mt *MemTable) SyncWal() error {
+	if mt.wal == nil {
+		return nil
+	}
 	return mt.wal.Sync()
 }
 
+// isFull checks both the arena usage and the WAL size against MemtableSize
 func (mt *MemTable) isFull() bool {
-	return false
+	if mt.skl.MemSize() >= mt.opts.MemtableSize {
+		return true
+	}
+	if mt.wal == nil {
+		// in-memory mode
+		return false
+	}
+	return int64(mt.wal.WriteAt()) >= mt.opts.MemtableSize
 }
 
 func mtFilePath(dirname string, fid int) string {
@@ -3,6 +3,7 @@ package tiny_badger
 import (
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"os"
 	"testing"
 	"tiny-badger/config"
 	"tiny-badger/structs"
@@ -71,3 +72,77 @@ func TestMemtablePut(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestMemtableReplay(t *testing.T) {
+	dir := utils.CreateTmpDir("memtable-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NotNil(t, db)
+
+	mt, err := db.newMemTable()
+	require.NoError(t, err)
+	fid := db.nextMemFid - 1
+
+	n := 100
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%05d", i*10+5)
+		value := structs.ValueStruct{Value: newValue(i), Meta: byte(i)}
+		require.NoError(t, mt.Put(utils.KeyWithTs([]byte(key), uint64(i)), value))
+	}
+	writeAt := mt.wal.WriteAt()
+
+	// reopen the memtable without closing it, just like a crash
+	mt2, err := db.openMemTable(fid, os.O_RDWR)
+	require.NoError(t, err)
+	require.Equal(t, writeAt, mt2.wal.WriteAt())
+	require.Equal(t, uint64(n-1), mt2.maxVersion)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%05d", i*10+5)
+		vs := mt2.skl.Get(utils.KeyWithTs([]byte(key), uint64(i)))
+		require.Equal(t, newValue(i), vs.Value)
+		require.Equal(t, byte(i), vs.Meta)
+	}
+}
+
+func TestMemtableReplayTornRecord(t *testing.T) {
+	dir := utils.CreateTmpDir("memtable-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NotNil(t, db)
+
+	mt, err := db.newMemTable()
+	require.NoError(t, err)
+	fid := db.nextMemFid - 1
+
+	var offsets []int
+	n := 10
+	for i := 0; i < n; i++ {
+		offsets = append(offsets, int(mt.wal.WriteAt()))
+		key := fmt.Sprintf("%05d", i)
+		require.NoError(t, mt.Put(utils.KeyWithTs([]byte(key), 0), structs.ValueStruct{Value: newValue(i)}))
+	}
+	// corrupt the value of the 6th record
+	mt.wal.Data[offsets[6]+10] ^= 0xff
+
+	mt2, err := db.openMemTable(fid, os.O_RDWR)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		vs := mt2.skl.Get(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0))
+		if i < 6 {
+			require.Equal(t, newValue(i), vs.Value)
+		} else {
+			require.Nil(t, vs.Value)
+		}
+	}
+
+	// the file is truncated at the torn record
+	fi, err := os.Stat(mtFilePath(dir, fid))
+	require.NoError(t, err)
+	require.EqualValues(t, offsets[6], fi.Size())
+}
@@ -12,6 +12,9 @@ import (
 const (
 	maxHeight      = 20
 	heightIncrease = math.MaxUint32 / 3
+	// prevLevel is the level findPrevs starts from, there are about 3^prevLevel nodes between two
+	// nodes on it
+	prevLevel = 3
 )
 
 const MaxNodeSize = int(unsafe.Sizeof(node{}))
@@ -182,13 +185,25 @@ func (s *Skiplist) Put(key []byte, val structs.ValueStruct) {
 	}
 }
 
+// Get returns the newest version of the key which is not newer than the version of key
 func (s *Skiplist) Get(key []byte) structs.ValueStruct {
-	n, eq := s.findNear(key, false, true) // >=
-	if !eq {
+	n, _ := s.findNear(key, false, true) // >=
+	if n == nil {
+		return structs.ValueStruct{}
+	}
+	nextKey := n.getKey(s.arena)
+	if !utils.SameKey(key, nextKey) {
 		return structs.ValueStruct{}
 	}
 
-	return n.getValue(s.arena)
+	vs := n.getValue(s.arena)
+	vs.Version = utils.ParseTs(nextKey)
+	return vs
+}
+
+// MemSize returns the size of arena that has been allocated
+func (s *Skiplist) MemSize() int64 {
+	return s.arena.size()
 }
 
 func (s *Skiplist) IsEmpty() bool {
@@ -310,6 +325,31 @@ func (s *Skiplist) findNear(key []byte, less bool, allowEqual bool) (*node, bool
 	}
 }
 
+// findPrevs appends the nodes before key to buf in ascending order. It starts from the last node
+// before key on prevLevel and walks forward on the base level, so only about 3^prevLevel nodes are
+// collected at a time, and the search costs O(log n) once for all of them.
+func (s *Skiplist) findPrevs(key []byte, buf []*node) []*node {
+	x := s.head
+	for height := int(s.getHeight() - 1); height >= prevLevel; height-- {
+		for next := s.getNext(x, height); next != nil; next = s.getNext(x, height) {
+			if utils.CompareKeys(next.getKey(s.arena), key) >= 0 {
+				break
+			}
+			x = next
+		}
+	}
+	if x != s.head {
+		buf = append(buf, x)
+	}
+	for next := s.getNext(x, 0); next != nil; next = s.getNext(next, 0) {
+		if utils.CompareKeys(next.getKey(s.arena), key) >= 0 {
+			break
+		}
+		buf = append(buf, next)
+	}
+	return buf
+}
+
 func (s *Skiplist) findLast() *node {
 	x := s.head
 	height := int(s.getHeight() - 1)
@@ -367,10 +407,20 @@ func (it *Iterator) Seek(key []byte) {
 	it.n, _ = it.skl.findNear(key, false, true) // ">=" key
 }
 
+// SeekForPrev finds the last key <= key
+func (it *Iterator) SeekForPrev(key []byte) {
+	it.n, _ = it.skl.findNear(key, true, true) // "<=" key
+}
+
 func (it *Iterator) SeekToFirst() {
 	it.n = it.skl.getNext(it.skl.head, 0)
 }
 
+// Rewind is the same as SeekToFirst, so the iterator could be merged with the table iterators
+func (it *Iterator) Rewind() {
+	it.SeekToFirst()
+}
+
 func (it *Iterator) SeekToLast() {
 	it.n = it.skl.findLast()
 }
@@ -382,3 +432,66 @@ func (it *Iterator) Key() []byte {
 func (it *Iterator) Value() structs.ValueStruct {
 	return it.n.getValue(it.skl.arena)
 }
+
+// UniIterator iterates the skiplist in one direction, so it could be merged with the table iterators
+type UniIterator struct {
+	iter     *Iterator
+	reversed bool
+	prevs    []*node // the nodes before the current one in reverse order, the nearest one is the last
+}
+
+// NewUniIterator walks the keys in descending order if reversed
+func NewUniIterator(skl *Skiplist, reversed bool) *UniIterator {
+	return &UniIterator{iter: NewIterator(skl), reversed: reversed}
+}
+
+// Next moves to the next key, or the previous one if reversed. The previous nodes are found a batch
+// at a time, so a step back costs O(1) amortized rather than a search from the head.
+func (it *UniIterator) Next() {
+	if !it.reversed {
+		it.iter.Next()
+		return
+	}
+	utils.AssertTrue(it.Valid())
+	if len(it.prevs) == 0 {
+		it.prevs = it.iter.skl.findPrevs(it.iter.Key(), it.prevs)
+		if len(it.prevs) == 0 {
+			it.iter.n = nil
+			return
+		}
+	}
+	n := len(it.prevs)
+	it.iter.n = it.prevs[n-1]
+	it.prevs[n-1] = nil
+	it.prevs = it.prevs[:n-1]
+}
+
+func (it *UniIterator) Rewind() {
+	it.resetPrevs()
+	if !it.reversed {
+		it.iter.SeekToFirst()
+	} else {
+		it.iter.SeekToLast()
+	}
+}
+
+// Seek to the first key >= key, or the last key <= key if reversed
+func (it *UniIterator) Seek(key []byte) {
+	it.resetPrevs()
+	if !it.reversed {
+		it.iter.Seek(key)
+	} else {
+		it.iter.SeekForPrev(key)
+	}
+}
+
+func (it *UniIterator) resetPrevs() {
+	clear(it.prevs)
+	it.prevs = it.prevs[:0]
+}
+
+func (it *UniIterator) Key() []byte                { return it.iter.Key() }
+func (it *UniIterator) Value() structs.ValueStruct { return it.iter.Value() }
+func (it *UniIterator) Valid() bool                { return it.iter.Valid() }
+func (it *UniIterator) Error() error               { return nil }
+func (it *UniIterator) Close() error               { return it.iter.Close() }
@@ -388,6 +388,75 @@ func TestIteratorPrev(t *testing.T) {
 	}
 }
 
+func TestUniIteratorReversed(t *testing.T) {
+	l := NewSkiplist(arenaSize)
+	defer l.DecrRef()
+	n := 100
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%05d", i*10+5)
+		l.Put(utils.KeyWithTs([]byte(key), 0), structs.ValueStruct{Value: newValue(i)})
+	}
+
+	iter := NewUniIterator(l, true)
+	defer iter.Close()
+	i := n - 1
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		require.Equal(t, newValue(i), iter.Value().Value)
+		i--
+	}
+	require.Equal(t, -1, i)
+
+	// the last key <= the seek key
+	iter.Seek(utils.KeyWithTs([]byte("00508"), 0))
+	require.True(t, iter.Valid())
+	require.Equal(t, utils.KeyWithTs([]byte("00505"), 0), iter.Key())
+	iter.Seek(utils.KeyWithTs([]byte("00505"), 0))
+	require.Equal(t, utils.KeyWithTs([]byte("00505"), 0), iter.Key())
+	iter.Seek(utils.KeyWithTs([]byte("00001"), 0))
+	require.False(t, iter.Valid())
+}
+
+func TestUniIteratorReversedBatches(t *testing.T) {
+	l := NewSkiplist(16 << 20)
+	defer l.DecrRef()
+	n := 10000
+	for i := 0; i < n; i++ {
+		l.Put(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), structs.ValueStruct{Value: newValue(i)})
+	}
+
+	iter := NewUniIterator(l, true)
+	defer iter.Close()
+	i, refills := n-1, 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), iter.Key())
+		if len(iter.prevs) == 0 {
+			refills++
+		}
+		i--
+	}
+	require.Equal(t, -1, i)
+	// the previous nodes are collected in small batches rather than all at once or one by one
+	require.Greater(t, refills, n/1000)
+	require.Less(t, refills, n/3)
+
+	// Seek drops the nodes buffered before
+	iter.Seek(utils.KeyWithTs([]byte("09000"), 0))
+	iter.Next()
+	// a batch is empty if the node before it is on prevLevel
+	for len(iter.prevs) == 0 {
+		iter.Next()
+	}
+	iter.Seek(utils.KeyWithTs([]byte("05000"), 0))
+	require.Equal(t, utils.KeyWithTs([]byte("05000"), 0), iter.Key())
+	for j := 4999; j >= 0; j-- {
+		iter.Next()
+		require.True(t, iter.Valid())
+		require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("%05d", j)), 0), iter.Key())
+	}
+	iter.Next()
+	require.False(t, iter.Valid())
+}
+
 func TestIteratorSeek(t *testing.T) {
 	l := NewSkiplist(arenaSize)
 	defer l.DecrRef()
@@ -495,3 +564,18 @@ func BenchmarkGetWriteMap(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkReverseIteration(b *testing.B) {
+	l := NewSkiplist(16 << 20)
+	defer l.DecrRef()
+	for i := 0; i < 10000; i++ {
+		l.Put(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), structs.ValueStruct{Value: newValue(i)})
+	}
+	iter := NewUniIterator(l, true)
+	defer iter.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+		}
+	}
+}
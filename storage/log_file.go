@@ -49,10 +49,77 @@ func (lf *LogFile) Open(flags int, fsize int64) error {
 	} else if err != nil {
 		return utils.Wrapf(err, "while opening file: %s", lf.path)
 	}
+	lf.size.Store(uint32(len(lf.Data)))
 
 	return err
 }
 
+// LogEntryFunc is called for every valid entry while iterating over the log file
+type LogEntryFunc func(e *structs.Entry, vp structs.ValuePointer) error
+
+// Iterate walks the records from offset, validating the checksum of each one. It stops at the
+// first torn or zeroed record, restores writeAt and returns the end offset of the last valid record.
+// fn could return ErrStop to stop the iteration early.
+func (lf *LogFile) Iterate(offset uint32, fn LogEntryFunc) (uint32, error) {
+	if offset < vlogHeaderSize {
+		offset = vlogHeaderSize
+	}
+
+	validEndOffset := offset
+	for {
+		e, recordLen, err := lf.decodeEntryAt(validEndOffset)
+		if err == utils.ErrEOF || err == utils.ErrTruncate {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		vp := structs.ValuePointer{
+			Fid:    lf.fid,
+			Len:    recordLen,
+			Offset: validEndOffset,
+		}
+		if err := fn(e, vp); err == utils.ErrStop {
+			// stopped by fn, the rest of file is not checked
+			return validEndOffset, nil
+		} else if err != nil {
+			return 0, utils.Wrapf(err, "iteration function for %s", lf.path)
+		}
+		validEndOffset += recordLen
+	}
+
+	lf.writeAt = validEndOffset
+	return validEndOffset, nil
+}
+
+// Truncate the file to end, drop all the records after it
+func (lf *LogFile) Truncate(end int64) error {
+	if int64(len(lf.Data)) == end {
+		return nil
+	}
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.size.Store(uint32(end))
+	return lf.MmapFile.Truncate(end)
+}
+
+// decodeEntryAt decodes the record at offset, returns ErrTruncate if the record is torn or zeroed
+func (lf *LogFile) decodeEntryAt(offset uint32) (*structs.Entry, uint32, error) {
+	if int(offset)+2 > len(lf.Data) {
+		return nil, 0, utils.ErrEOF
+	}
+	buf := lf.Data[offset:]
+	e, recordLen, err := decodeRecord(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	// a key always has a timestamp suffix, the zero key means the rest of file is not written
+	if len(e.Key) == 0 {
+		return nil, 0, utils.ErrTruncate
+	}
+	return e, recordLen, nil
+}
+
 func (lf *LogFile) WriteEntry(buf *bytes.Buffer, entry *structs.Entry) error {
 	buf.Reset()
 	recordLen, err := lf.encodeEntry(buf, entry, lf.writeAt)
@@ -65,6 +132,32 @@ func (lf *LogFile) WriteEntry(buf *bytes.Buffer, entry *structs.Entry) error {
 	return nil
 }
 
+// WriteAt returns the offset of the next record
+func (lf *LogFile) WriteAt() uint32 {
+	return lf.writeAt
+}
+
+// Read the entry which p points to, the key and value refer to the mmapped file
+func (lf *LogFile) Read(p structs.ValuePointer) (*structs.Entry, error) {
+	lf.lock.RLock()
+	defer lf.lock.RUnlock()
+
+	buf, err := lf.read(p)
+	if err != nil {
+		return nil, utils.Wrapf(err, "while reading %+v from %s", p, lf.path)
+	}
+	e, err := lf.decodeEntry(buf, p.Offset)
+	if err != nil {
+		return nil, utils.Wrapf(err, "while decoding %+v from %s", p, lf.path)
+	}
+	return e, nil
+}
+
+// Fid returns the id of the log file
+func (lf *LogFile) Fid() uint32 {
+	return lf.fid
+}
+
 func (lf *LogFile) read(p structs.ValuePointer) (buf []byte, err error) {
 	size := int64(len(lf.Data))
 	if int64(p.Offset) >= size || int64(p.Offset+p.Len) > size {
@@ -111,8 +204,29 @@ func (lf *LogFile) encodeEntry(buf *bytes.Buffer, entry *structs.Entry, offset u
 }
 
 func (lf *LogFile) decodeEntry(buf []byte, offset uint32) (*structs.Entry, error) {
+	e, _, err := decodeRecord(buf)
+	return e, err
+}
+
+// decodeRecord decodes an entry from buf and verifies its checksum, returns the entry and record length
+func decodeRecord(buf []byte) (*structs.Entry, uint32, error) {
 	var h structs.Header
 	headerLen := h.Decode(buf)
+	if headerLen == 0 {
+		return nil, 0, utils.ErrTruncate
+	}
+	recordLen := uint64(headerLen) + uint64(h.KeyLen) + uint64(h.ValLen) + crc32.Size
+	if recordLen > uint64(len(buf)) {
+		return nil, 0, utils.ErrTruncate
+	}
+
+	// verify the checksum of header, key and value
+	crcOffset := recordLen - crc32.Size
+	checksum := binary.LittleEndian.Uint32(buf[crcOffset:recordLen])
+	if crc32.Checksum(buf[:crcOffset], utils.CastagnoliCrcTable) != checksum {
+		return nil, 0, utils.ErrTruncate
+	}
+
 	kv := buf[headerLen:]
 	e := &structs.Entry{
 		Key:       kv[:h.KeyLen],
@@ -121,5 +235,5 @@ func (lf *LogFile) decodeEntry(buf []byte, offset uint32) (*structs.Entry, error
 		Meta:      h.Meta,
 		UserMeta:  h.UserMeta,
 	}
-	return e, nil
+	return e, uint32(recordLen), nil
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/dgraph-io/ristretto/v2/z"
 	"github.com/stretchr/testify/require"
 	"os"
@@ -109,4 +110,65 @@ func TestWriteReadEntry(t *testing.T) {
 	require.Equal(t, byte(1), e.Meta)
 	require.Equal(t, byte(2), e.UserMeta)
 	require.Equal(t, entry.ExpiresAt, e.ExpiresAt)
+
+	e, err = lf.Read(vp)
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("value"), e.Value)
+
+	// the pointer doesn't point to a record
+	vp.Offset++
+	_, err = lf.Read(vp)
+	require.Error(t, err)
+}
+
+func TestIterate(t *testing.T) {
+	f := makeTmpFile()
+	defer destoryFile(f.Name())
+
+	lf := NewLogFile(f.Name(), 1)
+	err := lf.Open(os.O_RDWR, logfileSize)
+	require.Equal(t, z.NewFile, err)
+
+	buf := new(bytes.Buffer)
+	n := 10
+	for i := 0; i < n; i++ {
+		entry := &structs.Entry{
+			Key:   utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), uint64(i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		require.NoError(t, lf.WriteEntry(buf, entry))
+	}
+	writeAt := lf.writeAt
+
+	lf2 := NewLogFile(f.Name(), 1)
+	require.NoError(t, lf2.Open(os.O_RDWR, logfileSize))
+
+	var i int
+	endOff, err := lf2.Iterate(0, func(e *structs.Entry, vp structs.ValuePointer) error {
+		require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), uint64(i)), e.Key)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", i)), e.Value)
+		require.Equal(t, uint32(1), vp.Fid)
+		i++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, n, i)
+	require.Equal(t, writeAt, endOff)
+	require.Equal(t, writeAt, lf2.writeAt)
+
+	// zero out part of the last record
+	lf.Data[writeAt-1] = 0
+	i = 0
+	endOff, err = lf2.Iterate(0, func(e *structs.Entry, vp structs.ValuePointer) error {
+		i++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, n-1, i)
+	require.Less(t, endOff, writeAt)
+
+	require.NoError(t, lf2.Truncate(int64(endOff)))
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.EqualValues(t, endOff, fi.Size())
 }
@@ -2,12 +2,30 @@ package structs
 
 import (
 	"encoding/binary"
+	"time"
 )
 
 const (
 	MaxHeaderSize = 22
 )
 
+// bits of Entry.Meta
+const (
+	BitDelete       byte = 1 << 0 // the entry is a tombstone
+	BitValuePointer byte = 1 << 1 // the value is a ValuePointer to the value log
+)
+
+// IsDeletedOrExpired checks whether the entry is a tombstone or has expired
+func IsDeletedOrExpired(meta byte, expiresAt uint64) bool {
+	if meta&BitDelete > 0 {
+		return true
+	}
+	if expiresAt == 0 {
+		return false
+	}
+	return expiresAt <= uint64(time.Now().Unix())
+}
+
 type Entry struct {
 	Key       []byte
 	Value     []byte
@@ -28,12 +46,53 @@ func (e *Entry) WithMeta(meta byte) *Entry {
 	return e
 }
 
+// EstimateSize returns the size of e written in the LSM tree, the value is replaced by a
+// ValuePointer if it's larger than threshold
+func (e *Entry) EstimateSize(threshold int64) int64 {
+	if int64(len(e.Value)) <= threshold {
+		return int64(MaxHeaderSize + len(e.Key) + len(e.Value))
+	}
+	return int64(MaxHeaderSize + len(e.Key) + vptrSize)
+}
+
+// WithTTL sets the entry to expire after dur, the expired entry is invisible to readers and
+// eventually dropped by compaction
+func (e *Entry) WithTTL(dur time.Duration) *Entry {
+	e.ExpiresAt = uint64(time.Now().Add(dur).Unix())
+	return e
+}
+
+// ValuePointer points to the record of an entry in the value log
 type ValuePointer struct {
 	Fid    uint32
 	Len    uint32
 	Offset uint32
 }
 
+const vptrSize = 12
+
+func (p ValuePointer) IsZero() bool {
+	return p.Fid == 0 && p.Len == 0 && p.Offset == 0
+}
+
+// Encode the pointer, it's stored as the value in LSM tree
+// +-----+-----+--------+
+// | Fid | Len | Offset |
+// +-----+-----+--------+
+func (p ValuePointer) Encode() []byte {
+	b := make([]byte, vptrSize)
+	binary.BigEndian.PutUint32(b[0:4], p.Fid)
+	binary.BigEndian.PutUint32(b[4:8], p.Len)
+	binary.BigEndian.PutUint32(b[8:12], p.Offset)
+	return b
+}
+
+func (p *ValuePointer) Decode(b []byte) {
+	p.Fid = binary.BigEndian.Uint32(b[0:4])
+	p.Len = binary.BigEndian.Uint32(b[4:8])
+	p.Offset = binary.BigEndian.Uint32(b[8:12])
+}
+
 // Header
 // +----+--------+------+------+---------+
 // |Meta|UserMeta|KeyLen|ValLen|ExpiresAt|
@@ -57,16 +116,29 @@ func (h *Header) Encode(buf []byte) int {
 	return idx
 }
 
+// Decode header from buf, returns 0 if buf doesn't hold a valid header
 func (h *Header) Decode(buf []byte) int {
+	if len(buf) < 2 {
+		return 0
+	}
 	h.Meta = buf[0]
 	h.UserMeta = buf[1]
 	idx := 2
 	kLen, cnt := binary.Uvarint(buf[idx:])
+	if cnt <= 0 {
+		return 0
+	}
 	h.KeyLen = uint32(kLen)
 	idx += cnt
 	vLen, cnt := binary.Uvarint(buf[idx:])
+	if cnt <= 0 {
+		return 0
+	}
 	h.ValLen = uint32(vLen)
 	idx += cnt
 	h.ExpiresAt, cnt = binary.Uvarint(buf[idx:])
+	if cnt <= 0 {
+		return 0
+	}
 	return idx + cnt
 }
@@ -0,0 +1,184 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+const (
+	// entry header: | keyLen(4 bytes) | valLen(4 bytes) |
+	entryHeaderSize = 8
+
+	// footer: | index offset(4 bytes) | index len(4 bytes) | index checksum(4 bytes) | magic(4 bytes) |
+	footerSize = 16
+
+	magicNumber uint32 = 0x7b1e55a7
+)
+
+// blockHandle locates a data block in the table file, baseKey is the first key of the block
+type blockHandle struct {
+	baseKey []byte
+	offset  uint32
+	len     uint32
+}
+
+// Builder builds a table file from keys added in sorted order
+// layout of table
+// +--------------+-----+--------------+-------+--------+
+// | data block 0 | ... | data block n | index | footer |
+// +--------------+-----+--------------+-------+--------+
+type Builder struct {
+	opts config.Options
+	buf  *bytes.Buffer
+
+	// current block
+	blockStart   uint32
+	baseKey      []byte
+	entryOffsets []uint32
+
+	blocks     []blockHandle
+	biggest    []byte
+	maxVersion uint64
+	keyCount   uint32
+}
+
+func NewTableBuilder(opts config.Options) *Builder {
+	return &Builder{
+		opts: opts,
+		buf:  new(bytes.Buffer),
+	}
+}
+
+// Add appends key and value to the table, keys must be added in increasing order
+func (b *Builder) Add(key []byte, vs structs.ValueStruct) {
+	if b.shouldFinishBlock() {
+		b.finishBlock()
+	}
+	if len(b.entryOffsets) == 0 {
+		b.baseKey = append(b.baseKey[:0], key...)
+	}
+	b.entryOffsets = append(b.entryOffsets, uint32(b.buf.Len())-b.blockStart)
+
+	// entry: | header | key | value |
+	var header [entryHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[4:8], vs.EncodedSize())
+	b.buf.Write(header[:])
+	b.buf.Write(key)
+	val := make([]byte, vs.EncodedSize())
+	vs.Encode(val)
+	b.buf.Write(val)
+
+	b.biggest = append(b.biggest[:0], key...)
+	if version := utils.ParseTs(key); version > b.maxVersion {
+		b.maxVersion = version
+	}
+	b.keyCount++
+}
+
+func (b *Builder) Empty() bool {
+	return b.keyCount == 0
+}
+
+// EstimateSize of the table file if Finish is called now
+func (b *Builder) EstimateSize() int64 {
+	sz := b.buf.Len() + 4*len(b.entryOffsets) + 8 + footerSize
+	for _, bh := range b.blocks {
+		sz += 12 + len(bh.baseKey)
+	}
+	return int64(sz + 12 + len(b.baseKey) + 4 + len(b.biggest) + 16)
+}
+
+// ReachedCapacity returns true if the table is going to be larger than capacity
+func (b *Builder) ReachedCapacity(capacity int64) bool {
+	return b.EstimateSize() >= capacity
+}
+
+func (b *Builder) shouldFinishBlock() bool {
+	if len(b.entryOffsets) == 0 {
+		return false
+	}
+	return b.buf.Len()-int(b.blockStart) >= b.opts.BlockSize
+}
+
+// finishBlock appends entry offsets, number of entries and checksum to current block
+// layout of block
+// +---------+-----+---------+---------------+----------------------+----------------+
+// | entry 0 | ... | entry n | entry offsets | num entries(4 bytes) | crc32(4 bytes) |
+// +---------+-----+---------+---------------+----------------------+----------------+
+func (b *Builder) finishBlock() {
+	if len(b.entryOffsets) == 0 {
+		return
+	}
+	var tmp [4]byte
+	for _, off := range b.entryOffsets {
+		binary.BigEndian.PutUint32(tmp[:], off)
+		b.buf.Write(tmp[:])
+	}
+	binary.BigEndian.PutUint32(tmp[:], uint32(len(b.entryOffsets)))
+	b.buf.Write(tmp[:])
+
+	checksum := crc32.Checksum(b.buf.Bytes()[b.blockStart:], utils.CastagnoliCrcTable)
+	binary.BigEndian.PutUint32(tmp[:], checksum)
+	b.buf.Write(tmp[:])
+
+	b.blocks = append(b.blocks, blockHandle{
+		baseKey: utils.SafeCopy(nil, b.baseKey),
+		offset:  b.blockStart,
+		len:     uint32(b.buf.Len()) - b.blockStart,
+	})
+	b.blockStart = uint32(b.buf.Len())
+	b.entryOffsets = b.entryOffsets[:0]
+}
+
+// Finish writes the index and footer, returns the content of the table file
+func (b *Builder) Finish() []byte {
+	b.finishBlock()
+
+	indexOffset := uint32(b.buf.Len())
+	index := encodeIndex(b.blocks, b.biggest, b.maxVersion, b.keyCount)
+	b.buf.Write(index)
+
+	var footer [footerSize]byte
+	binary.BigEndian.PutUint32(footer[0:4], indexOffset)
+	binary.BigEndian.PutUint32(footer[4:8], uint32(len(index)))
+	binary.BigEndian.PutUint32(footer[8:12], crc32.Checksum(index, utils.CastagnoliCrcTable))
+	binary.BigEndian.PutUint32(footer[12:16], magicNumber)
+	b.buf.Write(footer[:])
+	return b.buf.Bytes()
+}
+
+// encodeIndex
+// layout of index
+// +---------------------+---------------+-------------+----------------------+--------------------+
+// | num blocks(4 bytes) | block handles | biggest key | max version(8 bytes) | key count(4 bytes) |
+// +---------------------+---------------+-------------+----------------------+--------------------+
+// block handle: | keyLen(4 bytes) | baseKey | offset(4 bytes) | len(4 bytes) |
+// biggest key: | keyLen(4 bytes) | key |
+func encodeIndex(blocks []blockHandle, biggest []byte, maxVersion uint64, keyCount uint32) []byte {
+	buf := new(bytes.Buffer)
+	var tmp [8]byte
+	binary.BigEndian.PutUint32(tmp[:4], uint32(len(blocks)))
+	buf.Write(tmp[:4])
+	for _, bh := range blocks {
+		binary.BigEndian.PutUint32(tmp[:4], uint32(len(bh.baseKey)))
+		buf.Write(tmp[:4])
+		buf.Write(bh.baseKey)
+		binary.BigEndian.PutUint32(tmp[:4], bh.offset)
+		buf.Write(tmp[:4])
+		binary.BigEndian.PutUint32(tmp[:4], bh.len)
+		buf.Write(tmp[:4])
+	}
+	binary.BigEndian.PutUint32(tmp[:4], uint32(len(biggest)))
+	buf.Write(tmp[:4])
+	buf.Write(biggest)
+	binary.BigEndian.PutUint64(tmp[:], maxVersion)
+	buf.Write(tmp[:])
+	binary.BigEndian.PutUint32(tmp[:4], keyCount)
+	buf.Write(tmp[:4])
+	return buf.Bytes()
+}
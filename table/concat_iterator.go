@@ -0,0 +1,140 @@
+package table
+
+import (
+	"sort"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+// ConcatIterator iterates the tables which are sorted and don't overlap with each other, e.g. the tables of L1+
+type ConcatIterator struct {
+	tables   []*Table
+	iters    []*TableIterator // created lazily
+	idx      int              // index of current table
+	cur      *TableIterator
+	err      error
+	reversed bool
+}
+
+// NewConcatIterator holds a reference of the tables until it's closed, the keys are walked in
+// descending order if reversed
+func NewConcatIterator(tables []*Table, reversed bool) *ConcatIterator {
+	for _, t := range tables {
+		t.IncrRef()
+	}
+	return &ConcatIterator{
+		tables:   tables,
+		iters:    make([]*TableIterator, len(tables)),
+		idx:      -1,
+		reversed: reversed,
+	}
+}
+
+func (ci *ConcatIterator) setIdx(idx int) {
+	ci.idx = idx
+	if idx < 0 || idx >= len(ci.tables) {
+		ci.cur = nil
+		return
+	}
+	if ci.iters[idx] == nil {
+		if ci.reversed {
+			ci.iters[idx] = ci.tables[idx].NewReverseIterator()
+		} else {
+			ci.iters[idx] = ci.tables[idx].NewIterator()
+		}
+	}
+	ci.cur = ci.iters[idx]
+}
+
+func (ci *ConcatIterator) Rewind() {
+	ci.err = nil
+	if ci.reversed {
+		ci.setIdx(len(ci.tables) - 1)
+	} else {
+		ci.setIdx(0)
+	}
+	if ci.cur == nil {
+		return
+	}
+	ci.cur.Rewind()
+	ci.skipEmpty()
+}
+
+// Seek to the first key >= key, or the last key <= key if reversed
+func (ci *ConcatIterator) Seek(key []byte) {
+	var idx int
+	if !ci.reversed {
+		// the first table whose biggest key >= key
+		idx = sort.Search(len(ci.tables), func(i int) bool {
+			return utils.CompareKeys(ci.tables[i].Biggest(), key) >= 0
+		})
+	} else {
+		// the last table whose smallest key <= key
+		idx = sort.Search(len(ci.tables), func(i int) bool {
+			return utils.CompareKeys(ci.tables[i].Smallest(), key) > 0
+		}) - 1
+	}
+	ci.err = nil
+	ci.setIdx(idx)
+	if ci.cur == nil {
+		return
+	}
+	ci.cur.Seek(key)
+	ci.skipEmpty()
+}
+
+// skipEmpty moves to the first valid entry of the following tables if current table is exhausted
+func (ci *ConcatIterator) skipEmpty() {
+	for ci.cur != nil && !ci.cur.Valid() {
+		if err := ci.cur.Error(); err != nil {
+			ci.err = err
+			ci.cur = nil
+			return
+		}
+		if ci.reversed {
+			ci.setIdx(ci.idx - 1)
+		} else {
+			ci.setIdx(ci.idx + 1)
+		}
+		if ci.cur != nil {
+			ci.cur.Rewind()
+		}
+	}
+}
+
+// Error returns the error met while loading blocks of the tables
+func (ci *ConcatIterator) Error() error {
+	return ci.err
+}
+
+func (ci *ConcatIterator) Valid() bool {
+	return ci.cur != nil && ci.cur.Valid()
+}
+
+func (ci *ConcatIterator) Next() {
+	utils.AssertTrue(ci.Valid())
+	ci.cur.Next()
+	ci.skipEmpty()
+}
+
+func (ci *ConcatIterator) Key() []byte {
+	return ci.cur.Key()
+}
+
+func (ci *ConcatIterator) Value() structs.ValueStruct {
+	return ci.cur.Value()
+}
+
+// Close the table iterators created and release the tables
+func (ci *ConcatIterator) Close() error {
+	var err error
+	for _, it := range ci.iters {
+		if it != nil {
+			err = utils.CombineErrors(err, it.Close())
+		}
+	}
+	for _, t := range ci.tables {
+		err = utils.CombineErrors(err, t.DecrRef())
+	}
+	return utils.Wrapf(err, "ConcatIterator.Close")
+}
@@ -0,0 +1,214 @@
+package table
+
+import (
+	"encoding/binary"
+	"sort"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+// Iterator is implemented by the iterators of tables and memtables, so they can be merged together
+type Iterator interface {
+	Next()
+	Rewind()
+	Seek(key []byte)
+	Key() []byte
+	Value() structs.ValueStruct
+	Valid() bool
+	// Error returns the error which made the iterator invalid early, such as a corrupted block
+	Error() error
+	Close() error
+}
+
+type block struct {
+	data         []byte
+	entryOffsets []uint32
+}
+
+// blockIterator iterates the entries of a single block
+type blockIterator struct {
+	b   *block
+	idx int
+	key []byte
+	val []byte
+}
+
+func (bi *blockIterator) setBlock(b *block) {
+	bi.b = b
+	bi.idx = -1
+	bi.key = nil
+	bi.val = nil
+}
+
+func (bi *blockIterator) valid() bool {
+	return bi.b != nil && bi.idx >= 0 && bi.idx < len(bi.b.entryOffsets)
+}
+
+// setIdx decodes the entry at idx
+func (bi *blockIterator) setIdx(idx int) {
+	bi.idx = idx
+	if !bi.valid() {
+		return
+	}
+	off := bi.b.entryOffsets[idx]
+	data := bi.b.data[off:]
+	keyLen := binary.BigEndian.Uint32(data[0:4])
+	valLen := binary.BigEndian.Uint32(data[4:8])
+	data = data[entryHeaderSize:]
+	bi.key = data[:keyLen]
+	bi.val = data[keyLen : keyLen+valLen]
+}
+
+func (bi *blockIterator) seekToFirst() {
+	bi.setIdx(0)
+}
+
+// seek to the first entry >= key
+func (bi *blockIterator) seek(key []byte) {
+	idx := sort.Search(len(bi.b.entryOffsets), func(i int) bool {
+		bi.setIdx(i)
+		return utils.CompareKeys(bi.key, key) >= 0
+	})
+	bi.setIdx(idx)
+}
+
+// seekForPrev to the last entry <= key
+func (bi *blockIterator) seekForPrev(key []byte) {
+	idx := sort.Search(len(bi.b.entryOffsets), func(i int) bool {
+		bi.setIdx(i)
+		return utils.CompareKeys(bi.key, key) > 0
+	})
+	bi.setIdx(idx - 1)
+}
+
+func (bi *blockIterator) seekToLast() {
+	bi.setIdx(len(bi.b.entryOffsets) - 1)
+}
+
+func (bi *blockIterator) next() {
+	bi.setIdx(bi.idx + 1)
+}
+
+func (bi *blockIterator) prev() {
+	bi.setIdx(bi.idx - 1)
+}
+
+// TableIterator iterates all the entries of a table in key order, or in reverse order if reversed
+type TableIterator struct {
+	t        *Table
+	bpos     int // index of current block
+	bi       blockIterator
+	err      error
+	reversed bool
+}
+
+func (t *Table) NewIterator() *TableIterator {
+	t.IncrRef()
+	return &TableIterator{t: t, bpos: -1}
+}
+
+// NewReverseIterator walks the entries from the biggest key to the smallest one
+func (t *Table) NewReverseIterator() *TableIterator {
+	it := t.NewIterator()
+	it.reversed = true
+	return it
+}
+
+func (it *TableIterator) Close() error {
+	return it.t.DecrRef()
+}
+
+func (it *TableIterator) Valid() bool {
+	return it.err == nil && it.bi.valid()
+}
+
+// Error returns the error met while loading blocks, such as checksum mismatch
+func (it *TableIterator) Error() error {
+	return it.err
+}
+
+// loadBlock sets the block iterator to block idx
+func (it *TableIterator) loadBlock(idx int) bool {
+	it.bpos = idx
+	if idx < 0 || idx >= len(it.t.blocks) {
+		it.bi.setBlock(nil)
+		return false
+	}
+	b, err := it.t.block(idx)
+	if err != nil {
+		it.err = err
+		it.bi.setBlock(nil)
+		return false
+	}
+	it.bi.setBlock(b)
+	return true
+}
+
+func (it *TableIterator) Rewind() {
+	it.err = nil
+	if !it.reversed {
+		if it.loadBlock(0) {
+			it.bi.seekToFirst()
+		}
+		return
+	}
+	if it.loadBlock(len(it.t.blocks) - 1) {
+		it.bi.seekToLast()
+	}
+}
+
+// Seek to the first key >= key, or the last key <= key if reversed
+func (it *TableIterator) Seek(key []byte) {
+	it.err = nil
+	// the first block whose base key > key, so key lies in the block before it
+	idx := sort.Search(len(it.t.blocks), func(i int) bool {
+		return utils.CompareKeys(it.t.blocks[i].baseKey, key) > 0
+	})
+	if it.reversed {
+		// the base key of the block before idx is <= key, so the last key <= key is in it
+		if it.loadBlock(idx - 1) {
+			it.bi.seekForPrev(key)
+		}
+		return
+	}
+	if idx == 0 {
+		it.Rewind()
+		return
+	}
+	if !it.loadBlock(idx - 1) {
+		return
+	}
+	it.bi.seek(key)
+	if !it.bi.valid() && it.loadBlock(idx) {
+		// all keys in the block are smaller than key
+		it.bi.seekToFirst()
+	}
+}
+
+// Next moves to the next entry, or the previous one if reversed
+func (it *TableIterator) Next() {
+	utils.AssertTrue(it.Valid())
+	if it.reversed {
+		it.bi.prev()
+		if !it.bi.valid() && it.loadBlock(it.bpos-1) {
+			it.bi.seekToLast()
+		}
+		return
+	}
+	it.bi.next()
+	if !it.bi.valid() && it.loadBlock(it.bpos+1) {
+		it.bi.seekToFirst()
+	}
+}
+
+// Key returns the key with timestamp, it's only valid until the table is closed
+func (it *TableIterator) Key() []byte {
+	return it.bi.key
+}
+
+// Value returns the value, the slice is only valid until the table is closed
+func (it *TableIterator) Value() (vs structs.ValueStruct) {
+	vs.Decode(it.bi.val)
+	vs.Version = utils.ParseTs(it.bi.key)
+	return vs
+}
@@ -0,0 +1,139 @@
+package table
+
+import (
+	"container/heap"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+type mergeItem struct {
+	iter Iterator
+	idx  int // position in the iterators, the smaller one is newer
+}
+
+// mergeHeap is a min heap on the current key of the iterators, or a max heap if reversed, the
+// newer iterator wins on equal keys
+type mergeHeap struct {
+	items    []mergeItem
+	reversed bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	if cmp := utils.CompareKeys(h.items[i].iter.Key(), h.items[j].iter.Key()); cmp != 0 {
+		return (cmp < 0) != h.reversed
+	}
+	return h.items[i].idx < h.items[j].idx
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x any) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.items)
+	x := h.items[n-1]
+	h.items = h.items[:n-1]
+	return x
+}
+
+// MergeIterator merges several sorted iterators into one. If the same key appears in more than one
+// iterator, only the one from the newest iterator is kept. It stops at the first error met by the
+// iterators, otherwise the older versions shadowed by the broken one would be yielded.
+type MergeIterator struct {
+	iters []Iterator
+	h     mergeHeap
+	key   []byte // copy of current key, used to skip the duplicates
+	err   error
+}
+
+// NewMergeIterator the iterators should be ordered from the newest to the oldest, and walk the keys
+// in the same direction as reversed
+func NewMergeIterator(iters []Iterator, reversed bool) *MergeIterator {
+	return &MergeIterator{
+		iters: iters,
+		h:     mergeHeap{items: make([]mergeItem, 0, len(iters)), reversed: reversed},
+	}
+}
+
+// reset rebuilds the heap from the valid iterators
+func (mi *MergeIterator) reset() {
+	mi.h.items = mi.h.items[:0]
+	mi.err = nil
+	for i, it := range mi.iters {
+		if it.Valid() {
+			mi.h.items = append(mi.h.items, mergeItem{iter: it, idx: i})
+		} else if err := it.Error(); err != nil && mi.err == nil {
+			mi.err = err
+		}
+	}
+	heap.Init(&mi.h)
+	mi.setKey()
+}
+
+func (mi *MergeIterator) setKey() {
+	if mi.Valid() {
+		mi.key = append(mi.key[:0], mi.h.items[0].iter.Key()...)
+	}
+}
+
+func (mi *MergeIterator) Rewind() {
+	for _, it := range mi.iters {
+		it.Rewind()
+	}
+	mi.reset()
+}
+
+// Seek to the first key >= key, or the last key <= key if reversed
+func (mi *MergeIterator) Seek(key []byte) {
+	for _, it := range mi.iters {
+		it.Seek(key)
+	}
+	mi.reset()
+}
+
+func (mi *MergeIterator) Valid() bool {
+	return mi.err == nil && len(mi.h.items) > 0
+}
+
+// Error returns the first error met by the iterators
+func (mi *MergeIterator) Error() error {
+	return mi.err
+}
+
+// Next moves to the next key, skips the same key in the older iterators
+func (mi *MergeIterator) Next() {
+	utils.AssertTrue(mi.Valid())
+	for mi.Valid() && utils.CompareKeys(mi.h.items[0].iter.Key(), mi.key) == 0 {
+		top := mi.h.items[0].iter
+		top.Next()
+		if top.Valid() {
+			heap.Fix(&mi.h, 0)
+			continue
+		}
+		if err := top.Error(); err != nil {
+			mi.err = err
+			return
+		}
+		heap.Pop(&mi.h)
+	}
+	mi.setKey()
+}
+
+func (mi *MergeIterator) Key() []byte {
+	return mi.h.items[0].iter.Key()
+}
+
+func (mi *MergeIterator) Value() structs.ValueStruct {
+	return mi.h.items[0].iter.Value()
+}
+
+// Close all the underlying iterators
+func (mi *MergeIterator) Close() error {
+	var err error
+	for _, it := range mi.iters {
+		err = utils.CombineErrors(err, it.Close())
+	}
+	return utils.Wrapf(err, "MergeIterator.Close")
+}
@@ -0,0 +1,165 @@
+package table
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+// buildInMemoryTable builds a table with the keys in [start, end) by step
+func buildInMemoryTable(t *testing.T, id uint64, start, end, step int, suffix string) *Table {
+	b := NewTableBuilder(config.DefaultOptions(""))
+	for i := start; i < end; i += step {
+		b.Add(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			structs.ValueStruct{Value: []byte(fmt.Sprintf("%05d%s", i, suffix))})
+	}
+	tbl, err := OpenInMemoryTable(b.Finish(), id)
+	require.NoError(t, err)
+	return tbl
+}
+
+func TestMergeIterator(t *testing.T) {
+	newer := buildInMemoryTable(t, 2, 0, 100, 2, "new") // even keys
+	older := buildInMemoryTable(t, 1, 0, 100, 1, "old") // all keys
+	defer newer.DecrRef()
+	defer older.DecrRef()
+
+	it := NewMergeIterator([]Iterator{newer.NewIterator(), older.NewIterator()}, false)
+	defer it.Close()
+
+	i := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), it.Key())
+		suffix := "old"
+		if i%2 == 0 {
+			suffix = "new"
+		}
+		require.Equal(t, []byte(fmt.Sprintf("%05d%s", i, suffix)), it.Value().Value)
+		i++
+	}
+	require.Equal(t, 100, i)
+
+	it.Seek(utils.KeyWithTs([]byte("00050"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("00050new"), it.Value().Value)
+	it.Next()
+	require.Equal(t, []byte("00051old"), it.Value().Value)
+
+	it.Seek(utils.KeyWithTs([]byte("00100"), 0))
+	require.False(t, it.Valid())
+}
+
+func TestConcatIterator(t *testing.T) {
+	tables := []*Table{
+		buildInMemoryTable(t, 1, 0, 100, 1, "a"),
+		buildInMemoryTable(t, 2, 100, 200, 1, "b"),
+		buildInMemoryTable(t, 3, 300, 400, 1, "c"),
+	}
+	it := NewConcatIterator(tables, false)
+
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	require.Equal(t, 300, n)
+	require.NoError(t, it.Error())
+
+	it.Seek(utils.KeyWithTs([]byte("00150"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("00150b"), it.Value().Value)
+
+	// in the gap between the tables
+	it.Seek(utils.KeyWithTs([]byte("00250"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("00300c"), it.Value().Value)
+
+	it.Seek(utils.KeyWithTs([]byte("00400"), 0))
+	require.False(t, it.Valid())
+
+	require.NoError(t, it.Close())
+	for _, tbl := range tables {
+		require.NoError(t, tbl.DecrRef())
+	}
+}
+
+func TestReverseMergeAndConcat(t *testing.T) {
+	tables := []*Table{
+		buildInMemoryTable(t, 1, 0, 100, 1, "a"),
+		buildInMemoryTable(t, 2, 100, 200, 1, "b"),
+		buildInMemoryTable(t, 3, 300, 400, 1, "c"),
+	}
+	newer := buildInMemoryTable(t, 4, 0, 400, 3, "new")
+	it := NewMergeIterator([]Iterator{newer.NewReverseIterator(), NewConcatIterator(tables, true)}, true)
+
+	var prev []byte
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		if prev != nil {
+			require.Less(t, utils.CompareKeys(it.Key(), prev), 0)
+		}
+		prev = append(prev[:0], it.Key()...)
+		n++
+	}
+	// 300 keys in the tables and the multiples of 3 in [200, 300)
+	require.Equal(t, 333, n)
+
+	it.Seek(utils.KeyWithTs([]byte("00150"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("00150new"), it.Value().Value)
+	it.Next()
+	require.Equal(t, []byte("00149b"), it.Value().Value)
+
+	// in the gap between the tables
+	it.Seek(utils.KeyWithTs([]byte("00250"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("00249new"), it.Value().Value)
+	it.Next()
+	require.Equal(t, []byte("00246new"), it.Value().Value)
+
+	it.Seek(utils.KeyWithTs([]byte("0"), 0))
+	require.False(t, it.Valid())
+
+	require.NoError(t, it.Close())
+	require.NoError(t, newer.DecrRef())
+	for _, tbl := range tables {
+		require.NoError(t, tbl.DecrRef())
+	}
+}
+
+func TestMergeIteratorError(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.BlockSize = 100
+	b := NewTableBuilder(opts)
+	for i := 0; i < 100; i++ {
+		b.Add(utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0), structs.ValueStruct{Value: []byte("new")})
+	}
+	newer, err := OpenInMemoryTable(b.Finish(), 2)
+	require.NoError(t, err)
+	older := buildInMemoryTable(t, 1, 0, 100, 1, "old")
+	defer newer.DecrRef()
+	defer older.DecrRef()
+	require.Greater(t, len(newer.blocks), 2)
+
+	// corrupt the second block of the newer table
+	newer.Data[newer.blocks[1].offset] ^= 0xff
+	it := NewMergeIterator([]Iterator{newer.NewIterator(), older.NewIterator()}, false)
+	defer it.Close()
+
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, []byte("new"), it.Value().Value)
+		n++
+	}
+	// stops at the broken block rather than yielding the older values
+	require.Greater(t, n, 0)
+	require.Less(t, n, 100)
+	require.ErrorContains(t, it.Error(), utils.ErrChecksumMismatch.Error())
+
+	// Seek into the broken block reports the error as well
+	it.Seek(newer.blocks[1].baseKey)
+	require.False(t, it.Valid())
+	require.ErrorContains(t, it.Error(), utils.ErrChecksumMismatch.Error())
+}
@@ -0,0 +1,202 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"tiny-badger/utils"
+)
+
+const fileSuffix = ".sst"
+
+// Table is an immutable sorted table file, it's mmapped and shared by the levels and iterators,
+// the file is deleted once the reference count drops to 0
+type Table struct {
+	*z.MmapFile
+	id  uint64
+	ref atomic.Int32
+
+	blocks     []blockHandle
+	smallest   []byte
+	biggest    []byte
+	maxVersion uint64
+	keyCount   uint32
+}
+
+// CreateTable writes the content of builder to a new file at path and opens it
+func CreateTable(path string, builder *Builder) (*Table, error) {
+	data := builder.Finish()
+	mf, err := z.OpenMmapFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, len(data))
+	if err != z.NewFile {
+		if err == nil {
+			err = errors.Errorf("file %s already exists", path)
+		}
+		return nil, utils.Wrapf(err, "while creating table: %s", path)
+	}
+	copy(mf.Data, data)
+	if err := mf.Sync(); err != nil {
+		return nil, utils.Wrapf(err, "while syncing table: %s", path)
+	}
+	return OpenTable(mf)
+}
+
+// OpenInMemoryTable opens a table from data which is not backed by a file
+func OpenInMemoryTable(data []byte, id uint64) (*Table, error) {
+	t := &Table{MmapFile: &z.MmapFile{Data: data}, id: id}
+	t.ref.Store(1)
+	if err := t.readIndex(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenTable parses the index of an mmapped table file, the id is parsed from file name
+func OpenTable(mf *z.MmapFile) (*Table, error) {
+	id, ok := ParseFileID(mf.Fd.Name())
+	if !ok {
+		_ = mf.Close(-1)
+		return nil, errors.Errorf("invalid table file name: %s", mf.Fd.Name())
+	}
+	t := &Table{MmapFile: mf, id: id}
+	t.ref.Store(1)
+	if err := t.readIndex(); err != nil {
+		_ = mf.Close(-1)
+		return nil, utils.Wrapf(err, "while reading index of %s", mf.Fd.Name())
+	}
+	return t, nil
+}
+
+func (t *Table) readIndex() error {
+	if len(t.Data) < footerSize {
+		return errors.Errorf("table size %d is smaller than footer", len(t.Data))
+	}
+	footer := t.Data[len(t.Data)-footerSize:]
+	if binary.BigEndian.Uint32(footer[12:16]) != magicNumber {
+		return errors.New("invalid magic number")
+	}
+	indexOffset := binary.BigEndian.Uint32(footer[0:4])
+	indexLen := binary.BigEndian.Uint32(footer[4:8])
+	if uint64(indexOffset)+uint64(indexLen) > uint64(len(t.Data)-footerSize) {
+		return errors.New("index out of range")
+	}
+	index := t.Data[indexOffset : indexOffset+indexLen]
+	if crc32.Checksum(index, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(footer[8:12]) {
+		return utils.ErrChecksumMismatch
+	}
+
+	numBlocks := binary.BigEndian.Uint32(index[0:4])
+	idx := uint32(4)
+	t.blocks = make([]blockHandle, 0, numBlocks)
+	for i := uint32(0); i < numBlocks; i++ {
+		keyLen := binary.BigEndian.Uint32(index[idx:])
+		idx += 4
+		bh := blockHandle{baseKey: index[idx : idx+keyLen]}
+		idx += keyLen
+		bh.offset = binary.BigEndian.Uint32(index[idx:])
+		bh.len = binary.BigEndian.Uint32(index[idx+4:])
+		idx += 8
+		t.blocks = append(t.blocks, bh)
+	}
+	keyLen := binary.BigEndian.Uint32(index[idx:])
+	idx += 4
+	t.biggest = index[idx : idx+keyLen]
+	idx += keyLen
+	t.maxVersion = binary.BigEndian.Uint64(index[idx:])
+	t.keyCount = binary.BigEndian.Uint32(index[idx+8:])
+	if len(t.blocks) > 0 {
+		t.smallest = t.blocks[0].baseKey
+	}
+	return nil
+}
+
+// block returns the entries of block idx after verifying its checksum
+func (t *Table) block(idx int) (*block, error) {
+	bh := t.blocks[idx]
+	if uint64(bh.offset)+uint64(bh.len) > uint64(len(t.Data)) || bh.len < 8 {
+		return nil, errors.Errorf("block %d out of range in table %d", idx, t.id)
+	}
+	data := t.Data[bh.offset : bh.offset+bh.len]
+	crcOffset := len(data) - 4
+	if crc32.Checksum(data[:crcOffset], utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(data[crcOffset:]) {
+		return nil, utils.Wrapf(utils.ErrChecksumMismatch, "block %d in table %d", idx, t.id)
+	}
+
+	numEntries := binary.BigEndian.Uint32(data[crcOffset-4:])
+	offsetsStart := crcOffset - 4 - int(numEntries)*4
+	b := &block{
+		data:         data[:offsetsStart],
+		entryOffsets: make([]uint32, numEntries),
+	}
+	for i := range b.entryOffsets {
+		b.entryOffsets[i] = binary.BigEndian.Uint32(data[offsetsStart+4*i:])
+	}
+	return b, nil
+}
+
+func (t *Table) IncrRef() {
+	t.ref.Add(1)
+}
+
+// DecrRef deletes the table file once no one references it
+func (t *Table) DecrRef() error {
+	if t.ref.Add(-1) > 0 {
+		return nil
+	}
+	return t.Delete()
+}
+
+// Close the table without removing the file
+func (t *Table) Close() error {
+	return t.MmapFile.Close(-1)
+}
+
+func (t *Table) ID() uint64 {
+	return t.id
+}
+
+// Smallest key of the table
+func (t *Table) Smallest() []byte {
+	return t.smallest
+}
+
+// Biggest key of the table
+func (t *Table) Biggest() []byte {
+	return t.biggest
+}
+
+func (t *Table) MaxVersion() uint64 {
+	return t.maxVersion
+}
+
+func (t *Table) KeyCount() uint32 {
+	return t.keyCount
+}
+
+// Size of the table file
+func (t *Table) Size() int64 {
+	return int64(len(t.Data))
+}
+
+func NewFilename(id uint64, dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", id, fileSuffix))
+}
+
+// ParseFileID parses the table id from file name, returns false if it's not a table file
+func ParseFileID(name string) (uint64, bool) {
+	name = filepath.Base(name)
+	if !strings.HasSuffix(name, fileSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, fileSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
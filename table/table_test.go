@@ -0,0 +1,197 @@
+package table
+
+import (
+	"fmt"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+func key(i int) []byte {
+	return utils.KeyWithTs([]byte(fmt.Sprintf("%05d", i*10+5)), uint64(i))
+}
+
+func value(i int) []byte {
+	return []byte(fmt.Sprintf("%05d", i))
+}
+
+func buildTable(t *testing.T, dir string, n int) *Table {
+	opts := config.DefaultOptions(dir)
+	opts.BlockSize = 256
+	b := NewTableBuilder(opts)
+	for i := 0; i < n; i++ {
+		b.Add(key(i), structs.ValueStruct{Value: value(i), Meta: byte(i), UserMeta: 1, ExpiresAt: uint64(i)})
+	}
+	tbl, err := CreateTable(NewFilename(1, dir), b)
+	require.NoError(t, err)
+	return tbl
+}
+
+func TestBuildAndIterate(t *testing.T) {
+	dir := utils.CreateTmpDir("table-test")
+	defer utils.DestroyDir(dir)
+
+	n := 1000
+	tbl := buildTable(t, dir, n)
+	defer tbl.DecrRef()
+
+	require.Equal(t, uint64(1), tbl.ID())
+	require.Greater(t, len(tbl.blocks), 1)
+	require.Equal(t, key(0), tbl.Smallest())
+	require.Equal(t, key(n-1), tbl.Biggest())
+	require.Equal(t, uint64(n-1), tbl.MaxVersion())
+	require.Equal(t, uint32(n), tbl.KeyCount())
+
+	it := tbl.NewIterator()
+	defer it.Close()
+	i := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, key(i), it.Key())
+		vs := it.Value()
+		require.Equal(t, value(i), vs.Value)
+		require.Equal(t, byte(i), vs.Meta)
+		require.Equal(t, byte(1), vs.UserMeta)
+		require.Equal(t, uint64(i), vs.ExpiresAt)
+		require.Equal(t, uint64(i), vs.Version)
+		i++
+	}
+	require.NoError(t, it.Error())
+	require.Equal(t, n, i)
+}
+
+func TestSeek(t *testing.T) {
+	dir := utils.CreateTmpDir("table-test")
+	defer utils.DestroyDir(dir)
+
+	n := 1000
+	tbl := buildTable(t, dir, n)
+	defer tbl.DecrRef()
+
+	it := tbl.NewIterator()
+	defer it.Close()
+
+	// exact key
+	for _, i := range []int{0, 1, 99, 500, n - 1} {
+		it.Seek(key(i))
+		require.True(t, it.Valid())
+		require.Equal(t, key(i), it.Key())
+	}
+
+	// smaller than the first key
+	it.Seek(utils.KeyWithTs([]byte("00000"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, key(0), it.Key())
+
+	// between two keys
+	it.Seek(utils.KeyWithTs([]byte("05558"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, key(556), it.Key())
+
+	// bigger than the last key
+	it.Seek(utils.KeyWithTs([]byte("99999"), 0))
+	require.False(t, it.Valid())
+}
+
+func TestReverseIterator(t *testing.T) {
+	dir := utils.CreateTmpDir("table-test")
+	defer utils.DestroyDir(dir)
+
+	n := 1000
+	tbl := buildTable(t, dir, n)
+	defer tbl.DecrRef()
+
+	it := tbl.NewReverseIterator()
+	defer it.Close()
+	i := n - 1
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, key(i), it.Key())
+		require.Equal(t, value(i), it.Value().Value)
+		i--
+	}
+	require.NoError(t, it.Error())
+	require.Equal(t, -1, i)
+
+	// exact key
+	for _, i := range []int{0, 1, 99, 500, n - 1} {
+		it.Seek(key(i))
+		require.True(t, it.Valid())
+		require.Equal(t, key(i), it.Key())
+	}
+
+	// smaller than the first key
+	it.Seek(utils.KeyWithTs([]byte("00000"), 0))
+	require.False(t, it.Valid())
+
+	// between two keys
+	it.Seek(utils.KeyWithTs([]byte("05558"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, key(555), it.Key())
+	it.Next()
+	require.Equal(t, key(554), it.Key())
+
+	// bigger than the last key
+	it.Seek(utils.KeyWithTs([]byte("99999"), 0))
+	require.True(t, it.Valid())
+	require.Equal(t, key(n-1), it.Key())
+}
+
+func TestReopenTable(t *testing.T) {
+	dir := utils.CreateTmpDir("table-test")
+	defer utils.DestroyDir(dir)
+
+	n := 100
+	tbl := buildTable(t, dir, n)
+	require.NoError(t, tbl.Close())
+
+	path := NewFilename(1, dir)
+	id, ok := ParseFileID(path)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), id)
+	_, ok = ParseFileID(filepath.Join(dir, "00001.mem"))
+	require.False(t, ok)
+
+	mf, err := z.OpenMmapFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	tbl2, err := OpenTable(mf)
+	require.NoError(t, err)
+	require.Equal(t, key(n-1), tbl2.Biggest())
+
+	// the file is removed once the reference count drops to 0
+	require.NoError(t, tbl2.DecrRef())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := utils.CreateTmpDir("table-test")
+	defer utils.DestroyDir(dir)
+
+	tbl := buildTable(t, dir, 100)
+	defer tbl.DecrRef()
+
+	// corrupt the first block
+	tbl.Data[10] ^= 0xff
+	it := tbl.NewIterator()
+	defer it.Close()
+	it.Rewind()
+	require.False(t, it.Valid())
+	require.ErrorContains(t, it.Error(), utils.ErrChecksumMismatch.Error())
+}
+
+func TestInMemoryTable(t *testing.T) {
+	opts := config.DefaultOptions("")
+	b := NewTableBuilder(opts)
+	for i := 0; i < 10; i++ {
+		b.Add(key(i), structs.ValueStruct{Value: value(i)})
+	}
+	tbl, err := OpenInMemoryTable(b.Finish(), 7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), tbl.ID())
+	require.Equal(t, key(9), tbl.Biggest())
+	require.NoError(t, tbl.DecrRef())
+}
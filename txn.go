@@ -1,24 +1,316 @@
 package tiny_badger
 
 import (
+	"context"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"math"
+	"sync"
+	"sync/atomic"
 	"tiny-badger/structs"
 	"tiny-badger/utils"
 )
 
 // oracle The timestamp manager and conflict detector for transactions
 type oracle struct {
+	sync.Mutex             // guards the fields below
+	writeChLock sync.Mutex // keeps the commits sent to writeCh in the order of commitTs
+
+	isManaged bool // the timestamps are supplied by the callers, see Options.ManagedTxns
+	nextTxnTs uint64
+	discardTs uint64 // set by the callers in managed mode
+	// the committed transactions which might conflict with the running ones
+	committedTxns []committedTxn
+
+	// readMark tracks readTs of the running transactions, txnMark tracks the commits being applied
+	readMark *utils.WaterMark
+	txnMark  *utils.WaterMark
+	closer   *z.Closer
+
+	snapshotsLock sync.Mutex
+	// the count of the running transactions from NewTransactionAt at each readTs, readMark can't
+	// track them because their readTs could be older than the ones done
+	snapshots map[uint64]int
+}
+
+type committedTxn struct {
+	ts uint64
+	// fingerprints of the keys written by the transaction
+	conflictKeys map[uint64]struct{}
+}
+
+func newOracle(isManaged bool) *oracle {
+	return &oracle{
+		isManaged: isManaged,
+		readMark:  utils.NewWaterMark("badger.PendingReads"),
+		txnMark:   utils.NewWaterMark("badger.TxnTimestamp"),
+		closer:    z.NewCloser(2),
+		snapshots: make(map[uint64]int),
+	}
+}
+
+// init the oracle with the max version recovered, and start the watermarks
+func (o *oracle) init(maxVersion uint64) {
+	o.nextTxnTs = maxVersion + 1
+	o.readMark.SetDoneUntil(maxVersion)
+	o.txnMark.SetDoneUntil(maxVersion)
+	o.readMark.Init(o.closer)
+	o.txnMark.Init(o.closer)
+}
+
+// stop the watermarks after the commits in flight are done, no commit begins once the DB is closed
+func (o *oracle) stop() {
+	_ = o.txnMark.WaitForMark(context.Background(), o.txnMark.LastIndex())
+	o.closer.SignalAndWait()
+}
+
+// readTs returns the timestamp of latest commit, and waits until all the commits at or before it
+// are applied, so the transaction sees all of them
+func (o *oracle) readTs() uint64 {
+	o.Lock()
+	readTs := o.nextTxnTs - 1
+	o.readMark.Begin(readTs)
+	o.Unlock()
+
+	utils.Check(o.txnMark.WaitForMark(context.Background(), readTs))
+	return readTs
+}
+
+// doneRead is called once the transaction commits or is discarded
+func (o *oracle) doneRead(txn *Txn) {
+	if txn.doneRead {
+		return
+	}
+	txn.doneRead = true
+	if txn.snapshot {
+		o.releaseSnapshot(txn.readTs)
+		return
+	}
+	o.readMark.Done(txn.readTs)
+}
+
+// holdSnapshot keeps compaction from dropping the versions visible at readTs
+func (o *oracle) holdSnapshot(readTs uint64) {
+	o.snapshotsLock.Lock()
+	defer o.snapshotsLock.Unlock()
+	o.snapshots[readTs]++
+}
+
+func (o *oracle) releaseSnapshot(readTs uint64) {
+	o.snapshotsLock.Lock()
+	defer o.snapshotsLock.Unlock()
+	if o.snapshots[readTs]--; o.snapshots[readTs] == 0 {
+		delete(o.snapshots, readTs)
+	}
+}
+
+// doneCommit is called once the writes of commitTs are applied
+func (o *oracle) doneCommit(commitTs uint64) {
+	if o.isManaged {
+		return
+	}
+	o.txnMark.Done(commitTs)
+}
+
+// discardAtOrBelow returns the max version that compaction could discard if it's shadowed by a newer version
+func (o *oracle) discardAtOrBelow() uint64 {
+	if o.isManaged {
+		o.Lock()
+		defer o.Unlock()
+		return o.discardTs
+	}
+	ts := o.readMark.DoneUntil()
+	o.snapshotsLock.Lock()
+	defer o.snapshotsLock.Unlock()
+	for readTs := range o.snapshots {
+		// the newest version at or below readTs must be kept
+		if readTs == 0 {
+			return 0
+		}
+		ts = min(ts, readTs-1)
+	}
+	return ts
+}
+
+func (o *oracle) setDiscardTs(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.discardTs = ts
+	o.cleanupCommittedTransactions()
+}
+
+// hasConflict checks whether any key read by txn is written by the transactions committed after txn.readTs
+func (o *oracle) hasConflict(txn *Txn) bool {
+	if len(txn.reads) == 0 {
+		return false
+	}
+	for _, committed := range o.committedTxns {
+		if committed.ts <= txn.readTs {
+			continue
+		}
+		for _, ro := range txn.reads {
+			if _, has := committed.conflictKeys[ro]; has {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCommitTs returns the commitTs of txn, or conflict if txn read a stale key
+func (o *oracle) newCommitTs(txn *Txn) (ts uint64, conflict bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.hasConflict(txn) {
+		return 0, true
+	}
+
+	// the reads of txn are checked, it won't conflict with the later commits
+	o.doneRead(txn)
+	o.cleanupCommittedTransactions()
+
+	if o.isManaged {
+		ts = txn.commitTs
+	} else {
+		ts = o.nextTxnTs
+		o.nextTxnTs++
+		o.txnMark.Begin(ts)
+	}
+	if len(txn.conflictKeys) > 0 {
+		o.committedTxns = append(o.committedTxns, committedTxn{
+			ts:           ts,
+			conflictKeys: txn.conflictKeys,
+		})
+	}
+	return ts, false
+}
+
+// cleanupCommittedTransactions drops the committed transactions which no running transaction
+// could conflict with, must be called with lock held
+func (o *oracle) cleanupCommittedTransactions() {
+	maxReadTs := o.discardTs
+	if !o.isManaged {
+		maxReadTs = o.readMark.DoneUntil()
+	}
+	tmp := o.committedTxns[:0]
+	for _, txn := range o.committedTxns {
+		if txn.ts <= maxReadTs {
+			continue
+		}
+		tmp = append(tmp, txn)
+	}
+	o.committedTxns = tmp
 }
 
+// Item is the version of a key returned by Txn.Get, it's only valid until the transaction is discarded
 type Item struct {
 	key       []byte
-	vptr      []byte
+	vptr      []byte // the value, or the encoded ValuePointer if meta has BitValuePointer
 	value     []byte
 	version   uint64
 	expiresAt uint64
+	meta      byte
+	userMeta  byte
+	keysOnly  bool // the item is from a keys-only iterator
+	read      bool // the key is recorded as read by the iterator
+
+	// wg is done once the value is prefetched into value or err
+	wg         sync.WaitGroup
+	prefetched bool
+	err        error
 
 	txn *Txn
 }
 
+// Key returns the key, it's only valid while the transaction is open, use KeyCopy to keep it
+func (item *Item) Key() []byte {
+	return item.key
+}
+
+// KeyCopy returns a copy of the key into dst, dst is allocated if it's too small
+func (item *Item) KeyCopy(dst []byte) []byte {
+	return utils.SafeCopy(dst, item.key)
+}
+
+// Version returns the commit timestamp of the item
+func (item *Item) Version() uint64 {
+	return item.version
+}
+
+// UserMeta returns the user meta set with the entry
+func (item *Item) UserMeta() byte {
+	return item.userMeta
+}
+
+// IsDeletedOrExpired returns true if the item is a tombstone or has expired, such items are only
+// yielded by the iterators with AllVersions
+func (item *Item) IsDeletedOrExpired() bool {
+	return structs.IsDeletedOrExpired(item.meta, item.expiresAt)
+}
+
+// ExpiresAt returns the unix time in seconds when the item expires, 0 means it never expires
+func (item *Item) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
+// EstimatedSize returns the size of key and value, the value is not read from value log
+func (item *Item) EstimatedSize() int64 {
+	if item.meta&structs.BitValuePointer == 0 {
+		return int64(len(item.key) + len(item.vptr))
+	}
+	var vp structs.ValuePointer
+	vp.Decode(item.vptr)
+	return int64(vp.Len) // includes key, value and header
+}
+
+// Value calls fn with the value, which is read from value log lazily if needed. The value is only
+// valid inside fn, use ValueCopy or copy it to keep it.
+func (item *Item) Value(fn func(val []byte) error) error {
+	buf, err := item.yieldItemValue()
+	if err != nil {
+		return err
+	}
+	return fn(buf)
+}
+
+// prefetchValue reads the value ahead for the iterator
+func (item *Item) prefetchValue() {
+	item.value, item.err = item.readValue()
+	item.prefetched = true
+	item.wg.Done()
+}
+
+// yieldItemValue returns the value prefetched, or reads it now
+func (item *Item) yieldItemValue() ([]byte, error) {
+	if item.keysOnly {
+		return nil, utils.ErrKeysOnly
+	}
+	item.wg.Wait()
+	if item.prefetched {
+		return item.value, item.err
+	}
+	return item.readValue()
+}
+
+// readValue resolves the value from value log if the item holds a pointer
+func (item *Item) readValue() ([]byte, error) {
+	if item.meta&structs.BitValuePointer == 0 {
+		return item.vptr, nil
+	}
+	var vp structs.ValuePointer
+	vp.Decode(item.vptr)
+	return item.txn.db.vlog.read(vp)
+}
+
+// ValueCopy returns a copy of the value into dst, dst is allocated if it's too small
+func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
+	buf, err := item.yieldItemValue()
+	if err != nil {
+		return nil, err
+	}
+	return utils.SafeCopy(dst, buf), nil
+}
+
 type Txn struct {
 	pendingWrites map[string]*structs.Entry // cache writes during transaction
 
@@ -26,14 +318,76 @@ type Txn struct {
 	commitTs uint64
 	db       *DB
 
-	discarded bool
+	readsLock    sync.Mutex // guards reads, the keys could be read concurrently
+	reads        []uint64   // fingerprints of the keys read
+	conflictKeys map[uint64]struct{}
+	count        int64 // number of the writes
+	size         int64 // estimated size of the writes
+
+	update       bool // false if the transaction is read only
+	isBatch      bool // the transaction of a WriteBatch, see newBatchTxn
+	snapshot     bool // readTs is held by oracle.snapshots rather than readMark, see NewTransactionAt
+	discarded    bool
+	doneRead     bool
+	numIterators atomic.Int32
 }
 
-func (db *DB) NewTransaction() *Txn {
+// NewTransaction returns a transaction which reads the snapshot of the latest commit, the
+// read-only one neither keeps writes nor tracks reads for conflicts. It can't be used in managed mode.
+func (db *DB) NewTransaction(update bool) *Txn {
+	if db.opts.ManagedTxns {
+		panic("Cannot use NewTransaction with ManagedTxns=true. Use NewTransactionAt instead.")
+	}
 	txn := &Txn{
+		db:     db,
+		readTs: db.orc.readTs(),
+		update: update,
+	}
+	if update {
+		txn.pendingWrites = make(map[string]*structs.Entry)
+		txn.conflictKeys = make(map[uint64]struct{})
+	}
+	db.vlog.incrReaders()
+	return txn
+}
+
+// newBatchTxn returns the transaction of a WriteBatch batch. It only writes blindly, so it takes no
+// read timestamp from the oracle, tracks no conflicts and never reads from the value log, which
+// lets the batches be committed without waiting for the ones before them.
+func (db *DB) newBatchTxn() *Txn {
+	return &Txn{
 		db:            db,
 		pendingWrites: make(map[string]*structs.Entry),
+		update:        true,
+		isBatch:       true,
+		doneRead:      true,
 	}
+}
+
+// NewTransactionAt returns a transaction which reads the snapshot at readTs. Compaction keeps the
+// versions visible at readTs until the transaction is discarded, but the ones dropped before it
+// starts are gone. In managed mode, compaction only respects DB.SetDiscardTs instead. Only the
+// transactions in managed mode could be updated, and they're committed with Txn.CommitAt.
+func (db *DB) NewTransactionAt(readTs uint64, update bool) *Txn {
+	if update && !db.opts.ManagedTxns {
+		panic("Cannot update the transaction of NewTransactionAt with ManagedTxns=false.")
+	}
+	txn := &Txn{
+		db:       db,
+		readTs:   readTs,
+		update:   update,
+		doneRead: true,
+	}
+	if !db.opts.ManagedTxns {
+		txn.snapshot = true
+		txn.doneRead = false
+		db.orc.holdSnapshot(readTs)
+	}
+	if update {
+		txn.pendingWrites = make(map[string]*structs.Entry)
+		txn.conflictKeys = make(map[uint64]struct{})
+	}
+	db.vlog.incrReaders()
 	return txn
 }
 
@@ -41,6 +395,7 @@ func (txn *Txn) Set(key, value []byte) error {
 	return txn.SetEntry(structs.NewEntry(key, value))
 }
 
+// Get returns the newest version of key which is visible at readTs
 func (txn *Txn) Get(key []byte) (*Item, error) {
 	if len(key) == 0 {
 		return nil, utils.ErrEmptyKey
@@ -49,9 +404,22 @@ func (txn *Txn) Get(key []byte) (*Item, error) {
 	}
 
 	item := new(Item)
+	if e, has := txn.pendingWrites[string(key)]; has {
+		// read the pending write of the transaction, it's not a read from DB so no conflict tracked
+		if structs.IsDeletedOrExpired(e.Meta, e.ExpiresAt) {
+			return nil, utils.ErrKeyNotFound
+		}
+		item.key = key
+		item.vptr = e.Value
+		item.version = txn.readTs
+		item.expiresAt = e.ExpiresAt
+		item.meta = e.Meta &^ structs.BitValuePointer
+		item.userMeta = e.UserMeta
+		item.txn = txn
+		return item, nil
+	}
 
-	// todo set update to get value from pendingWrites
-
+	txn.addReadKey(key)
 	seek := utils.KeyWithTs(key, txn.readTs)
 	vs, err := txn.db.get(seek)
 	if err != nil {
@@ -60,18 +428,43 @@ func (txn *Txn) Get(key []byte) (*Item, error) {
 	if vs.Value == nil && vs.Meta == 0 {
 		return nil, utils.ErrKeyNotFound
 	}
-	if utils.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+	if structs.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 		return nil, utils.ErrKeyNotFound
 	}
 
 	item.key = key
-	item.vptr = utils.SafeCopy(item.vptr, vs.Value)
+	// the values from memtable live in the arena on Go heap, and the ones from tables are already
+	// copied out of the mmapped files, so there's no need to copy
+	item.vptr = vs.Value
 	item.version = vs.Version
 	item.expiresAt = vs.ExpiresAt
+	item.meta = vs.Meta
+	item.userMeta = vs.UserMeta
 	item.txn = txn
 	return item, nil
 }
 
+// addReadKey records the fingerprint of key to detect conflicts at commit
+func (txn *Txn) addReadKey(key []byte) {
+	if !txn.update {
+		// a read-only transaction never conflicts
+		return
+	}
+	fp := z.MemHash(key)
+	txn.readsLock.Lock()
+	txn.reads = append(txn.reads, fp)
+	txn.readsLock.Unlock()
+}
+
+// Delete writes a tombstone of key, which hides all the older versions
+func (txn *Txn) Delete(key []byte) error {
+	e := &structs.Entry{
+		Key:  key,
+		Meta: structs.BitDelete,
+	}
+	return txn.modify(e)
+}
+
 func (txn *Txn) SetEntry(entry *structs.Entry) error {
 	return txn.modify(entry)
 }
@@ -91,33 +484,158 @@ func (txn *Txn) Commit() error {
 	return commitCb()
 }
 
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(txn *Txn) error) error {
+	if db.IsClosed() {
+		return utils.ErrDBClosed
+	}
+	var txn *Txn
+	if db.opts.ManagedTxns {
+		txn = db.NewTransactionAt(math.MaxUint64, false)
+	} else {
+		txn = db.NewTransaction(false)
+	}
+	defer txn.Discard()
+	return fn(txn)
+}
+
+// Update runs fn in a read-write transaction and commits it, fn is run again in a new transaction
+// if the commit conflicts, at most Options.NumUpdateRetries times. It can't be used in managed mode.
+func (db *DB) Update(fn func(txn *Txn) error) error {
+	if db.IsClosed() {
+		return utils.ErrDBClosed
+	}
+	if db.opts.ManagedTxns {
+		panic("Update can only be used with ManagedTxns=false.")
+	}
+	for i := 0; ; i++ {
+		txn := db.NewTransaction(true)
+		err := fn(txn)
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+		if err = txn.Commit(); err != utils.ErrConflict || i >= db.opts.NumUpdateRetries {
+			return err
+		}
+	}
+}
+
+// CommitAt commits the transaction at commitTs in managed mode, the keys are stamped with commitTs.
+// It waits for the writes to be applied if cb is nil, otherwise cb is called as in CommitWith.
+func (txn *Txn) CommitAt(commitTs uint64, cb func(error)) error {
+	if !txn.db.opts.ManagedTxns {
+		panic("Cannot use CommitAt with ManagedTxns=false. Use Commit instead.")
+	}
+	txn.commitTs = commitTs
+	if cb == nil {
+		return txn.Commit()
+	}
+	txn.CommitWith(cb)
+	return nil
+}
+
+// CommitWith commits the transaction without waiting for the writes to be applied, cb is called
+// with the result from another goroutine. The transaction is discarded once CommitWith returns.
+func (txn *Txn) CommitWith(cb func(error)) {
+	if cb == nil {
+		panic("Nil callback provided to CommitWith")
+	}
+	if len(txn.pendingWrites) == 0 {
+		txn.Discard()
+		go cb(nil)
+		return
+	}
+
+	defer txn.Discard()
+
+	commitCb, err := txn.commitAndSend()
+	if err != nil {
+		go cb(err)
+		return
+	}
+	go func() {
+		cb(commitCb())
+	}()
+}
+
 func (txn *Txn) Discard() {
 	if txn.discarded {
 		return
 	}
+	if txn.numIterators.Load() > 0 {
+		panic("Unclosed iterator at time of Txn.Discard.")
+	}
 	txn.discarded = true
+	txn.db.orc.doneRead(txn)
+	if txn.isBatch {
+		return
+	}
+	if err := txn.db.vlog.decrReaders(); err != nil {
+		txn.db.log.Errorf("while discarding txn: %v", err)
+	}
 }
 
 // modify The internal methods to change the db value
 func (txn *Txn) modify(entry *structs.Entry) error {
+	switch {
+	case !txn.update:
+		return utils.ErrReadOnlyTxn
+	case txn.discarded:
+		return utils.ErrDiscardedTxn
+	case len(entry.Key) == 0:
+		return utils.ErrEmptyKey
+	}
+	if err := txn.db.vlog.validateEntry(entry); err != nil {
+		return err
+	}
+	// the writes are sent in one request, which must fit in the memtable
+	count := txn.count + 1
+	size := txn.size + entry.EstimateSize(txn.db.vlog.valueThreshold())
+	if count >= txn.db.opts.MaxBatchCount || size >= txn.db.opts.MaxBatchSize {
+		return utils.ErrTxnTooBig
+	}
+	txn.count, txn.size = count, size
+	if txn.conflictKeys != nil {
+		txn.conflictKeys[z.MemHash(entry.Key)] = struct{}{}
+	}
 	txn.pendingWrites[string(entry.Key)] = entry
 	return nil
 }
 
-// commitAndSend internal method to send db changes to write channel
+// commitAndSend internal method to send db changes to write channel, the keys are stamped with commitTs
 func (txn *Txn) commitAndSend() (func() error, error) {
+	orc := txn.db.orc
+	if orc.isManaged && txn.commitTs == 0 {
+		panic("Commit cannot be called with ManagedTxns=true. Use CommitAt.")
+	}
+	// the oracle is stopped once the DB is closed, so no commit could begin after that
+	txn.db.closeLock.RLock()
+	defer txn.db.closeLock.RUnlock()
+	if txn.db.IsClosed() {
+		return nil, utils.ErrDBClosed
+	}
+	// the commits must reach writeCh in the order of commitTs
+	orc.writeChLock.Lock()
+	defer orc.writeChLock.Unlock()
+
+	commitTs, conflict := orc.newCommitTs(txn)
+	if conflict {
+		return nil, utils.ErrConflict
+	}
+	txn.commitTs = commitTs
+
 	entries := make([]*structs.Entry, 0, len(txn.pendingWrites))
 	for _, entry := range txn.pendingWrites {
+		entry.Key = utils.KeyWithTs(entry.Key, commitTs)
 		entries = append(entries, entry)
 	}
-	req, err := txn.db.sendToWriteCh(entries)
-	if err != nil {
-		return nil, err
-	}
+	req := txn.db.sendToWriteChLocked(entries)
 	ret := func() error {
-		// wait request to finish
-		err = req.Wait()
+		// wait request to finish, the commit is visible to new transactions after that
+		err := req.Wait()
+		orc.doneCommit(commitTs)
 		return err
 	}
-	return ret, err
+	return ret, nil
 }
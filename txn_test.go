@@ -0,0 +1,607 @@
+package tiny_badger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"sync"
+	"testing"
+	"time"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+func TestTxnSnapshotIsolation(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		txnSet(t, db, key, []byte("val1"), 0x00)
+		old := db.NewTransaction(true)
+		defer old.Discard()
+		txnSet(t, db, key, []byte("val2"), 0x00)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.Equal(t, old.readTs+1, txn.readTs)
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("val2"), getItemValue(t, item))
+		require.Equal(t, txn.readTs, item.version)
+
+		// the older transaction still reads the version at its readTs
+		item, err = old.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("val1"), getItemValue(t, item))
+		require.Equal(t, old.readTs, item.version)
+	})
+}
+
+func TestTxnConflict(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		txnSet(t, db, key, []byte("val1"), 0x00)
+
+		txn1 := db.NewTransaction(true)
+		_, err := txn1.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, txn1.Set(key, []byte("txn1")))
+
+		// a blind write never conflicts
+		txn2 := db.NewTransaction(true)
+		require.NoError(t, txn2.Set(key, []byte("txn2")))
+		require.NoError(t, txn2.Commit())
+
+		// txn1 read the key which was changed after its readTs
+		require.Equal(t, utils.ErrConflict, txn1.Commit())
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("txn2"), getItemValue(t, item))
+
+		// reading the other keys doesn't conflict
+		txn3 := db.NewTransaction(true)
+		_, err = txn3.Get([]byte("other"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		txnSet(t, db, key, []byte("val3"), 0x00)
+		require.NoError(t, txn3.Set([]byte("other"), []byte("txn3")))
+		require.NoError(t, txn3.Commit())
+	})
+}
+
+func TestOracleCleanupCommittedTxns(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0x00)
+		}
+		// the commits after txn.readTs are kept to check its conflicts
+		require.Len(t, db.orc.committedTxns, 10)
+		require.Equal(t, txn.readTs, db.orc.discardAtOrBelow())
+		txn.Discard()
+
+		// all the reads before the last commit are done
+		require.Eventually(t, func() bool {
+			return db.orc.discardAtOrBelow() == db.orc.nextTxnTs-2
+		}, time.Second, time.Millisecond)
+		txnSet(t, db, []byte("key"), []byte("val"), 0x00)
+		require.LessOrEqual(t, len(db.orc.committedTxns), 2)
+	})
+}
+
+func TestCommitVisibleInOrder(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		n := 100
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				txn := db.NewTransaction(true)
+				require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("val")))
+				readTs := txn.readTs
+				require.NoError(t, txn.Commit())
+
+				// the commit is applied once Commit returns
+				check := db.NewTransaction(true)
+				defer check.Discard()
+				require.Greater(t, check.readTs, readTs)
+				_, err := check.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+		require.EqualValues(t, n, db.orc.txnMark.DoneUntil())
+
+		// a new transaction sees all the commits before its readTs
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.EqualValues(t, n, txn.readTs)
+		for i := 0; i < n; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestTxnTsAfterReopen(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		txnSet(t, db, []byte("key"), []byte(fmt.Sprintf("val%d", i)), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.EqualValues(t, 6, db.orc.nextTxnTs)
+	txnSet(t, db, []byte("key"), []byte("val5"), 0x00)
+
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	item, err := txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val5"), getItemValue(t, item))
+	require.EqualValues(t, 6, item.version)
+}
+
+func TestTxnReadYourOwnWrites(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("key"), []byte("old"), 0x00)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("key"), []byte("new")))
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), getItemValue(t, item))
+		require.Equal(t, txn.readTs, item.version)
+		// reading the own write is not tracked for conflicts
+		require.Empty(t, txn.reads)
+
+		// the pending delete and expired entries hide the key
+		require.NoError(t, txn.Delete([]byte("key")))
+		_, err = txn.Get([]byte("key"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		e := structs.NewEntry([]byte("key2"), []byte("val"))
+		e.ExpiresAt = 1
+		require.NoError(t, txn.SetEntry(e))
+		_, err = txn.Get([]byte("key2"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+
+		// the other transactions don't see the pending writes
+		other := db.NewTransaction(true)
+		defer other.Discard()
+		item, err = other.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("old"), getItemValue(t, item))
+	})
+}
+
+func TestTxnDelete(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	n := 100
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("val"), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	// the tombstones in memtable hide the values in L0
+	db, err = Open(opts)
+	require.NoError(t, err)
+	old := db.NewTransaction(true)
+	txn := db.NewTransaction(true)
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, txn.Delete([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	require.NoError(t, txn.Commit())
+	check := func(db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if i%2 == 0 {
+				require.Equal(t, utils.ErrKeyNotFound, err)
+			} else {
+				require.NoError(t, err)
+			}
+		}
+	}
+	check(db)
+	// the transaction started before the deletes still sees the values
+	_, err = old.Get([]byte("key000"))
+	require.NoError(t, err)
+	old.Discard()
+	require.NoError(t, db.Close())
+
+	// compaction drops the tombstones and the values they shadow
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	check(db)
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	require.NoError(t, db.lc.doCompact(0))
+	check(db)
+
+	var keys int
+	for _, tbl := range db.lc.levels[1].tables {
+		it := tbl.NewIterator()
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.False(t, structs.IsDeletedOrExpired(it.Value().Meta, it.Value().ExpiresAt))
+			keys++
+		}
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, n/2, keys)
+}
+
+func TestTxnTTL(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.SetEntry(structs.NewEntry([]byte("long"), []byte("val")).WithTTL(time.Hour)))
+	require.NoError(t, txn.SetEntry(structs.NewEntry([]byte("short"), []byte("val")).WithTTL(time.Second)))
+	require.NoError(t, txn.Set([]byte("forever"), []byte("val")))
+	require.NoError(t, txn.Commit())
+
+	txn = db.NewTransaction(true)
+	item, err := txn.Get([]byte("long"))
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), item.ExpiresAt(), 1)
+	item, err = txn.Get([]byte("forever"))
+	require.NoError(t, err)
+	require.Zero(t, item.ExpiresAt())
+	txn.Discard()
+
+	require.Eventually(t, func() bool {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		_, err := txn.Get([]byte("short"))
+		return err == utils.ErrKeyNotFound
+	}, 3*time.Second, 100*time.Millisecond)
+	require.NoError(t, db.Close())
+
+	// compaction drops the expired key
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.lc.doCompact(0))
+	var keys []string
+	for _, tbl := range db.lc.levels[1].tables {
+		it := tbl.NewIterator()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(utils.ParseKey(it.Key())))
+		}
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, []string{"forever", "long"}, keys)
+}
+
+func TestItemAPI(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.ValueThreshold = 32
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		e := structs.NewEntry([]byte("small"), []byte("val"))
+		e.UserMeta = 7
+		require.NoError(t, txn.SetEntry(e))
+		require.NoError(t, txn.Set([]byte("large"), largeValue(1)))
+		require.NoError(t, txn.Commit())
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		item, err := txn.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("small"), item.Key())
+		key := item.KeyCopy(nil)
+		require.Equal(t, []byte("small"), key)
+		require.EqualValues(t, 1, item.Version())
+		require.EqualValues(t, 7, item.UserMeta())
+		require.EqualValues(t, len("small")+len("val"), item.EstimatedSize())
+
+		// the value in memtable is not copied
+		vs := db.mt.skl.Get(utils.KeyWithTs([]byte("small"), txn.readTs))
+		require.NoError(t, item.Value(func(val []byte) error {
+			require.Equal(t, []byte("val"), val)
+			require.Same(t, &vs.Value[0], &val[0])
+			return nil
+		}))
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.NotSame(t, &vs.Value[0], &val[0])
+
+		// the value pointer is resolved lazily
+		item, err = txn.Get([]byte("large"))
+		require.NoError(t, err)
+		require.NotZero(t, item.meta&structs.BitValuePointer)
+		require.Greater(t, item.EstimatedSize(), int64(len(largeValue(1))))
+		require.NoError(t, item.Value(func(val []byte) error {
+			require.Equal(t, largeValue(1), val)
+			return nil
+		}))
+	})
+}
+
+func TestTxnTooBig(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// the limits are derived from MemtableSize
+		require.Equal(t, db.opts.MemtableSize*15/100, db.opts.MaxBatchSize)
+		require.NotZero(t, db.opts.MaxBatchCount)
+	})
+
+	opts := config.DefaultOptions("")
+	opts.MaxBatchCount = 10
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		for i := 0; i < 9; i++ {
+			require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+		}
+		require.Equal(t, utils.ErrTxnTooBig, txn.Set([]byte("key9"), []byte("val")))
+		// the writes accepted are still committed
+		require.NoError(t, txn.Commit())
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		_, err := txn.Get([]byte("key8"))
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("key9"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+	})
+
+	opts = config.DefaultOptions("")
+	opts.MaxBatchSize = 1 << 10
+	opts.ValueThreshold = 1000
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.Equal(t, utils.ErrTxnTooBig, txn.Set([]byte("key"), make([]byte, 1000)))
+		// only the pointer of a value in value log counts
+		require.NoError(t, txn.Set([]byte("key"), make([]byte, 1001)))
+	})
+}
+
+func TestTxnCommitWith(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		n := 100
+		var wg sync.WaitGroup
+		errs := make(chan error, n+2)
+		cb := func(err error) {
+			errs <- err
+			wg.Done()
+		}
+		for i := 0; i < n; i++ {
+			txn := db.NewTransaction(true)
+			require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%03d", i)), newValue(i)))
+			wg.Add(1)
+			txn.CommitWith(cb)
+		}
+
+		// a transaction read the key changed by a later commit
+		stale := db.NewTransaction(true)
+		_, err := stale.Get([]byte("key000"))
+		require.NoError(t, err)
+		require.NoError(t, stale.Set([]byte("key000"), []byte("stale")))
+		txnSet(t, db, []byte("key000"), newValue(0), 0x00)
+		wg.Add(2)
+		stale.CommitWith(cb)
+		db.NewTransaction(true).CommitWith(cb)
+
+		wg.Wait()
+		close(errs)
+		var conflicts int
+		for err := range errs {
+			if err == utils.ErrConflict {
+				conflicts++
+			} else {
+				require.NoError(t, err)
+			}
+		}
+		require.Equal(t, 1, conflicts)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, newValue(i), getItemValue(t, item))
+		}
+	})
+}
+
+func TestTxnCommitWithClose(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	db, err := Open(config.DefaultOptions(dir))
+	require.NoError(t, err)
+
+	// the commits racing Close either succeed or fail with ErrDBClosed
+	n := 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%03d", i)), newValue(i)))
+		go txn.CommitWith(func(err error) {
+			defer wg.Done()
+			if err != nil {
+				assert.Equal(t, utils.ErrDBClosed, err)
+			}
+		})
+	}
+	late := db.NewTransaction(true)
+	require.NoError(t, late.Set([]byte("late"), []byte("val")))
+	require.NoError(t, db.Close())
+	wg.Wait()
+
+	errCh := make(chan error, 1)
+	late.CommitWith(func(err error) {
+		errCh <- err
+	})
+	require.Equal(t, utils.ErrDBClosed, <-errCh)
+}
+
+func TestManagedTxns(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.ManagedTxns = true
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.Panics(t, func() { db.NewTransaction(true) })
+
+	setAt := func(key, val string, commitTs uint64) error {
+		txn := db.NewTransactionAt(commitTs-1, true)
+		require.NoError(t, txn.Set([]byte(key), []byte(val)))
+		return txn.CommitAt(commitTs, nil)
+	}
+	getAt := func(key string, readTs uint64) (string, error) {
+		txn := db.NewTransactionAt(readTs, false)
+		defer txn.Discard()
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return "", err
+		}
+		require.LessOrEqual(t, item.Version(), readTs)
+		return string(getItemValue(t, item)), nil
+	}
+	require.NoError(t, setAt("key", "v10", 10))
+	require.NoError(t, setAt("key", "v20", 20))
+
+	// a transaction read the key changed after its readTs
+	txn := db.NewTransactionAt(15, true)
+	_, err = txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, txn.Set([]byte("key"), []byte("v25")))
+	require.Equal(t, utils.ErrConflict, txn.CommitAt(25, nil))
+
+	errCh := make(chan error, 1)
+	txn = db.NewTransactionAt(29, true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("v30")))
+	require.NoError(t, txn.CommitAt(30, func(err error) { errCh <- err }))
+	require.NoError(t, <-errCh)
+
+	wb := db.NewWriteBatchAt(40)
+	require.NoError(t, wb.Set([]byte("other"), []byte("v40")))
+	require.NoError(t, wb.Flush())
+
+	for readTs, want := range map[uint64]string{9: "", 10: "v10", 19: "v10", 25: "v20", 30: "v30", 100: "v30"} {
+		val, err := getAt("key", readTs)
+		if want == "" {
+			require.Equal(t, utils.ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, want, val)
+	}
+	_, err = getAt("other", 39)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	val, err := getAt("other", 40)
+	require.NoError(t, err)
+	require.Equal(t, "v40", val)
+	require.NoError(t, db.Close())
+
+	// compaction keeps the versions visible at or above discardTs
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	db.SetDiscardTs(25)
+	require.NoError(t, db.lc.doCompact(0))
+	var versions []uint64
+	for _, tbl := range db.lc.levels[1].tables {
+		it := tbl.NewIterator()
+		for it.Seek(utils.KeyWithTs([]byte("key"), math.MaxUint64)); it.Valid(); it.Next() {
+			if !utils.SameKey(it.Key(), utils.KeyWithTs([]byte("key"), 0)) {
+				break
+			}
+			versions = append(versions, utils.ParseTs(it.Key()))
+		}
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, []uint64{30, 20}, versions)
+	val, err = getAt("key", 25)
+	require.NoError(t, err)
+	require.Equal(t, "v20", val)
+}
+
+func TestReadOnlyTxn(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("key"), []byte("val"), 0x00)
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), getItemValue(t, item))
+		require.Empty(t, txn.reads)
+		require.Equal(t, utils.ErrReadOnlyTxn, txn.Set([]byte("key"), []byte("val2")))
+		require.Equal(t, utils.ErrReadOnlyTxn, txn.Delete([]byte("key")))
+		require.NoError(t, txn.Commit())
+	})
+}
+
+func TestViewAndUpdate(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.NumUpdateRetries = 2
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), []byte("0"))
+		}))
+
+		// every run of fn conflicts with the write made after its read
+		var runs int
+		update := func(txn *Txn) error {
+			runs++
+			if _, err := txn.Get([]byte("key")); err != nil {
+				return err
+			}
+			if runs <= 3 {
+				txnSet(t, db, []byte("key"), []byte(fmt.Sprintf("%d", runs)), 0x00)
+			}
+			return txn.Set([]byte("key"), []byte("update"))
+		}
+		require.Equal(t, utils.ErrConflict, db.Update(update))
+		require.Equal(t, 3, runs)
+
+		runs = 1
+		require.NoError(t, db.Update(update))
+		require.Equal(t, 4, runs)
+
+		err := db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("update"), getItemValue(t, item))
+			return txn.Set([]byte("key"), []byte("view"))
+		})
+		require.Equal(t, utils.ErrReadOnlyTxn, err)
+	})
+}
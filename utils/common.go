@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 	"os"
-	"time"
 )
 
 var (
@@ -20,10 +20,11 @@ func CompareKeys(key1, key2 []byte) int {
 	return bytes.Compare(key1[len(key1)-8:], key2[len(key2)-8:])
 }
 
+// KeyWithTs appends the inverted ts to key, so the newer versions of a key are sorted first
 func KeyWithTs(key []byte, ts uint64) []byte {
 	out := make([]byte, len(key)+8)
 	copy(out, key)
-	binary.BigEndian.PutUint64(out[len(out)-8:], ts)
+	binary.BigEndian.PutUint64(out[len(out)-8:], math.MaxUint64-ts)
 	return out
 }
 
@@ -31,7 +32,23 @@ func ParseTs(key []byte) uint64 {
 	if len(key) < 8 {
 		return 0
 	}
-	return binary.BigEndian.Uint64(key[len(key)-8:])
+	return math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// ParseKey returns the user key without timestamp
+func ParseKey(key []byte) []byte {
+	if len(key) < 8 {
+		return key
+	}
+	return key[:len(key)-8]
+}
+
+// SameKey checks whether the two keys have the same user key, regardless of timestamp
+func SameKey(src, dst []byte) bool {
+	if len(src) != len(dst) {
+		return false
+	}
+	return bytes.Equal(ParseKey(src), ParseKey(dst))
 }
 
 func SizeVarint(x uint64) (n int) {
@@ -54,16 +71,6 @@ func DestroyDir(dir string) {
 	_ = os.RemoveAll(dir)
 }
 
-func IsDeletedOrExpired(meta byte, expiresAt uint64) bool {
-	if meta&bitDeleted > 0 {
-		return true
-	}
-	if expiresAt == 0 {
-		return false
-	}
-	return expiresAt <= uint64(time.Now().Unix())
-}
-
 func SafeCopy(d, src []byte) []byte {
 	return append(d[:0], src...)
 }
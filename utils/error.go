@@ -11,6 +11,10 @@ var debugMode = false
 var (
 	ErrEOF = errors.New("ErrEOF: End of file")
 
+	ErrTruncate = errors.New("Do truncate")
+
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+
 	ErrDBClosed = errors.New("DB Closed")
 
 	ErrEmptyKey = errors.New("Key cannot be empty")
@@ -18,6 +22,24 @@ var (
 	ErrDiscardedTxn = errors.New("This transaction is discarded. Create a new one")
 
 	ErrKeyNotFound = errors.New("Key not found")
+
+	ErrConflict = errors.New("Transaction Conflict. Please retry")
+
+	ErrTxnTooBig = errors.New("Txn is too big to fit into one request")
+
+	ErrReadOnlyTxn = errors.New("No sets or deletes are allowed in a read-only transaction")
+
+	ErrKeysOnly = errors.New("Value is not available in keys-only iteration")
+
+	ErrStop = errors.New("Stop iteration")
+
+	ErrInvalidRequest = errors.New("Invalid request")
+
+	ErrNoRewrite = errors.New("Value log GC attempt didn't result in any cleanup")
+
+	ErrRejected = errors.New("Value log GC request rejected")
+
+	ErrGCInMemoryMode = errors.New("Cannot run value log GC when DB is opened in InMemory mode")
 )
 
 // Check logs fatal if err != nil.
@@ -35,24 +35,24 @@ func NewDefaultLogger(level loggerLevel) *DefaultLogger {
 
 func (l *DefaultLogger) Errorf(format string, args ...interface{}) {
 	if l.level <= ERROR {
-		l.Errorf("Error: "+format, args...)
+		l.Printf("Error: "+format, args...)
 	}
 }
 
 func (l *DefaultLogger) Warningf(format string, args ...interface{}) {
 	if l.level <= WARNING {
-		l.Warningf("Warning: "+format, args...)
+		l.Printf("Warning: "+format, args...)
 	}
 }
 
 func (l *DefaultLogger) Infof(format string, args ...interface{}) {
 	if l.level <= INFO {
-		l.Infof("Info: "+format, args...)
+		l.Printf("Info: "+format, args...)
 	}
 }
 
 func (l *DefaultLogger) Debugf(format string, args ...interface{}) {
 	if l.level <= DEBUG {
-		l.Debugf("Debug: "+format, args...)
+		l.Printf("Debug: "+format, args...)
 	}
 }
@@ -1,5 +0,0 @@
-package utils
-
-const (
-	bitDeleted byte = 1 << 0
-)
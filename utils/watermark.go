@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"container/heap"
+	"context"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"sync/atomic"
+)
+
+// WaterMark tracks the indices which have begun and are done. DoneUntil is the max index that
+// all the indices at or below it are done. The marks are processed in order by a goroutine.
+type WaterMark struct {
+	doneUntil atomic.Uint64
+	lastIndex atomic.Uint64
+	Name      string
+	markCh    chan mark
+}
+
+type mark struct {
+	index  uint64
+	waiter chan struct{} // closed once index is done
+	done   bool          // begin or done
+}
+
+func NewWaterMark(name string) *WaterMark {
+	return &WaterMark{Name: name}
+}
+
+// Init starts the goroutine to process the marks, it stops once closer is signaled
+func (w *WaterMark) Init(closer *z.Closer) {
+	w.markCh = make(chan mark, 100)
+	go w.process(closer)
+}
+
+// Begin marks index as pending
+func (w *WaterMark) Begin(index uint64) {
+	w.lastIndex.Store(index)
+	w.markCh <- mark{index: index, done: false}
+}
+
+// Done marks index as done
+func (w *WaterMark) Done(index uint64) {
+	w.markCh <- mark{index: index, done: true}
+}
+
+// DoneUntil returns the max index that all the indices at or below it are done
+func (w *WaterMark) DoneUntil() uint64 {
+	return w.doneUntil.Load()
+}
+
+// SetDoneUntil should only be called before any index begins
+func (w *WaterMark) SetDoneUntil(val uint64) {
+	w.doneUntil.Store(val)
+}
+
+// LastIndex returns the last index passed to Begin
+func (w *WaterMark) LastIndex() uint64 {
+	return w.lastIndex.Load()
+}
+
+// WaitForMark waits until index is done or ctx is canceled
+func (w *WaterMark) WaitForMark(ctx context.Context, index uint64) error {
+	if w.DoneUntil() >= index {
+		return nil
+	}
+	waitCh := make(chan struct{})
+	w.markCh <- mark{index: index, waiter: waitCh}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-waitCh:
+		return nil
+	}
+}
+
+// uint64Heap is a min heap of the pending indices
+type uint64Heap []uint64
+
+func (u uint64Heap) Len() int            { return len(u) }
+func (u uint64Heap) Less(i, j int) bool  { return u[i] < u[j] }
+func (u uint64Heap) Swap(i, j int)       { u[i], u[j] = u[j], u[i] }
+func (u *uint64Heap) Push(x interface{}) { *u = append(*u, x.(uint64)) }
+func (u *uint64Heap) Pop() interface{} {
+	old := *u
+	n := len(old)
+	x := old[n-1]
+	*u = old[0 : n-1]
+	return x
+}
+
+// process advances doneUntil once the smallest pending indices are all done, and notifies the waiters
+func (w *WaterMark) process(closer *z.Closer) {
+	defer closer.Done()
+
+	var indices uint64Heap
+	// the begin count minus the done count of each index
+	pending := make(map[uint64]int)
+	waiters := make(map[uint64][]chan struct{})
+
+	heap.Init(&indices)
+
+	processOne := func(index uint64, done bool) {
+		prev, present := pending[index]
+		if !present {
+			heap.Push(&indices, index)
+		}
+		delta := 1
+		if done {
+			delta = -1
+		}
+		pending[index] = prev + delta
+
+		doneUntil := w.DoneUntil()
+		AssertTruef(doneUntil <= index, "%s: index %d begins or is done after doneUntil %d", w.Name, index, doneUntil)
+
+		until := doneUntil
+		for len(indices) > 0 {
+			min := indices[0]
+			if done := pending[min]; done > 0 {
+				break // still pending
+			}
+			heap.Pop(&indices)
+			delete(pending, min)
+			until = min
+		}
+
+		if until != doneUntil {
+			AssertTrue(w.doneUntil.CompareAndSwap(doneUntil, until))
+		}
+
+		notifyAndRemove := func(idx uint64, toNotify []chan struct{}) {
+			for _, ch := range toNotify {
+				close(ch)
+			}
+			delete(waiters, idx)
+		}
+		if until-doneUntil <= uint64(len(waiters)) {
+			for idx := doneUntil + 1; idx <= until; idx++ {
+				if toNotify, ok := waiters[idx]; ok {
+					notifyAndRemove(idx, toNotify)
+				}
+			}
+		} else {
+			for idx, toNotify := range waiters {
+				if idx <= until {
+					notifyAndRemove(idx, toNotify)
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-closer.HasBeenClosed():
+			return
+		case mark := <-w.markCh:
+			if mark.waiter != nil {
+				doneUntil := w.doneUntil.Load()
+				if doneUntil >= mark.index {
+					close(mark.waiter)
+				} else {
+					waiters[mark.index] = append(waiters[mark.index], mark.waiter)
+				}
+			} else {
+				processOne(mark.index, mark.done)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"context"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWaterMark(t *testing.T) {
+	closer := z.NewCloser(1)
+	defer closer.SignalAndWait()
+	w := NewWaterMark("test")
+	w.Init(closer)
+
+	w.Begin(1)
+	w.Begin(2)
+	w.Begin(3)
+	require.EqualValues(t, 3, w.LastIndex())
+
+	// 1 is still pending
+	w.Done(2)
+	w.Done(3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, w.WaitForMark(ctx, 3))
+	require.Zero(t, w.DoneUntil())
+
+	waitCh := make(chan error)
+	go func() {
+		waitCh <- w.WaitForMark(context.Background(), 3)
+	}()
+	w.Done(1)
+	require.NoError(t, <-waitCh)
+	require.EqualValues(t, 3, w.DoneUntil())
+	require.NoError(t, w.WaitForMark(context.Background(), 2))
+}
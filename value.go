@@ -1,13 +1,29 @@
 package tiny_badger
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"tiny-badger/config"
+	"tiny-badger/storage"
 	"tiny-badger/structs"
+	"tiny-badger/utils"
 )
 
 type request struct {
 	Entries []*structs.Entry
+	Ptrs    []structs.ValuePointer // pointers to the value log, zero if the value is kept in LSM tree
 	Wg      sync.WaitGroup
 	Err     error
 	ref     atomic.Int32
@@ -15,6 +31,7 @@ type request struct {
 
 func (req *request) reset() {
 	req.Entries = req.Entries[:0]
+	req.Ptrs = req.Ptrs[:0]
 	req.Wg = sync.WaitGroup{}
 	req.Err = nil
 	req.ref.Store(0)
@@ -30,6 +47,7 @@ func (req *request) DecrRef() {
 		return
 	}
 	req.Entries = nil
+	req.Ptrs = nil
 	requestPool.Put(req)
 }
 
@@ -39,3 +57,492 @@ func (req *request) Wait() error {
 	req.DecrRef()
 	return err
 }
+
+const (
+	vlogFileExt = ".vlog"
+	// reserved header of a vlog file, same as storage.vlogHeaderSize
+	vlogHeaderSize = 20
+
+	// GC samples at least gcSampleRatio of the file and gcSampleCount entries
+	gcSampleRatio = 0.1
+	gcSampleCount = 10
+	// limits of a request while rewriting the live entries
+	gcBatchCount = 1000
+	gcBatchSize  = 4 << 20
+)
+
+// valueLog keeps the values larger than ValueThreshold out of LSM tree (WiscKey), the LSM tree only
+// stores a ValuePointer to the record. Only the file with maxFid is writable.
+type valueLog struct {
+	dirPath string
+	db      *DB
+	opts    config.Options
+
+	filesLock        sync.RWMutex
+	filesMap         map[uint32]*storage.LogFile
+	maxFid           uint32
+	filesToBeDeleted []uint32 // rewritten by GC, deleted once there's no active reader
+	buf              bytes.Buffer
+	discardStats     *discardStats
+
+	numActiveReaders atomic.Int32
+	garbageCh        chan struct{} // only one GC could run at a time
+}
+
+func vlogFilePath(dirPath string, fid uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%06d%s", fid, vlogFileExt))
+}
+
+// estimateRecordSize returns the max size of the record of e in the value log
+func estimateRecordSize(e *structs.Entry) int64 {
+	return int64(structs.MaxHeaderSize + len(e.Key) + len(e.Value) + crc32.Size)
+}
+
+// open the vlog files in dir, a new file is always created for the writes after reopening
+func (vlog *valueLog) open(db *DB) error {
+	vlog.db = db
+	vlog.opts = db.opts
+	vlog.dirPath = db.opts.Dir
+	vlog.filesMap = make(map[uint32]*storage.LogFile)
+	vlog.garbageCh = make(chan struct{}, 1)
+	if db.opts.InMemory {
+		return nil
+	}
+
+	fids, err := vlog.populateFids()
+	if err != nil {
+		return err
+	}
+	if !vlog.opts.ReadOnly {
+		if vlog.discardStats, err = initDiscardStats(vlog.opts); err != nil {
+			return utils.Wrapf(err, "while initializing discard stats")
+		}
+	}
+	flags := os.O_RDWR
+	if vlog.opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	for i, fid := range fids {
+		lf := storage.NewLogFile(vlogFilePath(vlog.dirPath, fid), int(fid))
+		if err := lf.Open(flags, 0); err != nil {
+			_ = vlog.close()
+			return utils.Wrapf(err, "while opening vlog file %d", fid)
+		}
+		vlog.filesMap[fid] = lf
+		vlog.maxFid = fid
+		if i < len(fids)-1 || vlog.opts.ReadOnly {
+			continue
+		}
+		// the last file may be torn by a crash
+		endOff, err := lf.Iterate(0, func(*structs.Entry, structs.ValuePointer) error { return nil })
+		if err == nil {
+			err = lf.Truncate(int64(endOff))
+		}
+		if err != nil {
+			_ = vlog.close()
+			return utils.Wrapf(err, "while truncating vlog file %d", fid)
+		}
+	}
+
+	if vlog.opts.ReadOnly {
+		return nil
+	}
+	if _, err := vlog.createVlogFile(); err != nil {
+		_ = vlog.close()
+		return err
+	}
+	return nil
+}
+
+func (vlog *valueLog) populateFids() ([]uint32, error) {
+	files, err := os.ReadDir(vlog.dirPath)
+	if err != nil {
+		return nil, utils.Wrapf(err, "while opening dir %s for value log", vlog.dirPath)
+	}
+	var fids []uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), vlogFileExt) {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), vlogFileExt), 10, 32)
+		if err != nil {
+			return nil, utils.Wrapf(err, "parse file %s to int", file.Name())
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	return fids, nil
+}
+
+// createVlogFile creates the file next to maxFid and makes it writable
+func (vlog *valueLog) createVlogFile() (*storage.LogFile, error) {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	// fid starts from 1, the zero fid marks the end of discard stats
+	fid := vlog.maxFid + 1
+	path := vlogFilePath(vlog.dirPath, fid)
+	lf := storage.NewLogFile(path, int(fid))
+	if err := lf.Open(os.O_RDWR|os.O_CREATE|os.O_EXCL, vlog.opts.ValueLogFileSize); err != z.NewFile {
+		return nil, utils.Wrapf(err, "while creating vlog file %s", path)
+	}
+	if err := z.SyncDir(vlog.dirPath); err != nil {
+		return nil, utils.Wrapf(err, "while syncing dir %s", vlog.dirPath)
+	}
+	vlog.filesMap[fid] = lf
+	vlog.maxFid = fid
+	return lf, nil
+}
+
+// valueThreshold returns the size above which the values are written to the value log
+func (vlog *valueLog) valueThreshold() int64 {
+	if vlog.opts.InMemory {
+		return math.MaxInt64
+	}
+	return vlog.opts.ValueThreshold
+}
+
+// validateEntry rejects the entry which doesn't fit in an empty vlog file
+func (vlog *valueLog) validateEntry(e *structs.Entry) error {
+	if int64(len(e.Value)) <= vlog.valueThreshold() {
+		return nil
+	}
+	if sz := estimateRecordSize(e); sz > vlog.opts.ValueLogFileSize-vlogHeaderSize {
+		return errors.Errorf("Entry with size %d exceeded ValueLogFileSize %d", sz, vlog.opts.ValueLogFileSize)
+	}
+	return nil
+}
+
+func (vlog *valueLog) writableFile() *storage.LogFile {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	return vlog.filesMap[vlog.maxFid]
+}
+
+// write appends the values larger than ValueThreshold to the value log, and records their pointers
+// in req.Ptrs. It's called serially by writeRequests.
+func (vlog *valueLog) write(reqs []*request) error {
+	var lf *storage.LogFile
+	if !vlog.opts.InMemory {
+		lf = vlog.writableFile()
+	}
+	for _, req := range reqs {
+		req.Ptrs = req.Ptrs[:0]
+		for _, e := range req.Entries {
+			if lf == nil || int64(len(e.Value)) <= vlog.opts.ValueThreshold {
+				req.Ptrs = append(req.Ptrs, structs.ValuePointer{})
+				continue
+			}
+			if err := vlog.validateEntry(e); err != nil {
+				return err
+			}
+			if int64(lf.WriteAt())+estimateRecordSize(e) > vlog.opts.ValueLogFileSize {
+				var err error
+				if lf, err = vlog.rotate(lf); err != nil {
+					return err
+				}
+			}
+
+			vp := structs.ValuePointer{Fid: lf.Fid(), Offset: lf.WriteAt()}
+			if err := lf.WriteEntry(&vlog.buf, e); err != nil {
+				return utils.Wrapf(err, "while writing to vlog file %d", lf.Fid())
+			}
+			vp.Len = lf.WriteAt() - vp.Offset
+			req.Ptrs = append(req.Ptrs, vp)
+		}
+	}
+	if lf != nil && vlog.opts.SyncWrites {
+		return utils.Wrapf(lf.Sync(), "while syncing vlog file %d", lf.Fid())
+	}
+	return nil
+}
+
+// rotate syncs and shrinks the full file, then creates a new writable one
+func (vlog *valueLog) rotate(lf *storage.LogFile) (*storage.LogFile, error) {
+	if err := lf.Sync(); err != nil {
+		return nil, utils.Wrapf(err, "while syncing vlog file %d", lf.Fid())
+	}
+	if err := lf.Truncate(int64(lf.WriteAt())); err != nil {
+		return nil, utils.Wrapf(err, "while truncating vlog file %d", lf.Fid())
+	}
+	return vlog.createVlogFile()
+}
+
+// read returns a copy of the value which vp points to
+func (vlog *valueLog) read(vp structs.ValuePointer) ([]byte, error) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	lf, ok := vlog.filesMap[vp.Fid]
+	if !ok {
+		return nil, errors.Errorf("vlog file %d not found", vp.Fid)
+	}
+	e, err := lf.Read(vp)
+	if err != nil {
+		return nil, err
+	}
+	return utils.SafeCopy(nil, e.Value), nil
+}
+
+// close the vlog files, the writable file is shrunk to its valid size or removed if it's empty
+func (vlog *valueLog) close() error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	var err error
+	for fid, lf := range vlog.filesMap {
+		if vlog.toBeDeleted(fid) {
+			err = utils.CombineErrors(err, lf.Delete())
+		} else if fid != vlog.maxFid || vlog.opts.ReadOnly {
+			err = utils.CombineErrors(err, lf.Close(-1))
+		} else if lf.WriteAt() == vlogHeaderSize {
+			err = utils.CombineErrors(err, lf.Delete())
+		} else {
+			err = utils.CombineErrors(err, lf.Close(int64(lf.WriteAt())))
+		}
+	}
+	vlog.filesMap = nil
+	vlog.filesToBeDeleted = nil
+	return utils.CombineErrors(err, vlog.discardStats.close())
+}
+
+// toBeDeleted must be called with filesLock held
+func (vlog *valueLog) toBeDeleted(fid uint32) bool {
+	for _, id := range vlog.filesToBeDeleted {
+		if id == fid {
+			return true
+		}
+	}
+	return false
+}
+
+// incrReaders is called by a new transaction, the values it reads stay in the vlog files until
+// the transaction is discarded
+func (vlog *valueLog) incrReaders() {
+	vlog.numActiveReaders.Add(1)
+}
+
+func (vlog *valueLog) decrReaders() error {
+	if vlog.numActiveReaders.Add(-1) > 0 {
+		return nil
+	}
+	return vlog.deleteMarkedFiles()
+}
+
+// deleteMarkedFiles removes the files rewritten by GC if there's no active reader. The readers
+// started after marking only see the rewritten pointers, so they never read the marked files.
+func (vlog *valueLog) deleteMarkedFiles() error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	if vlog.numActiveReaders.Load() > 0 || vlog.filesMap == nil {
+		return nil
+	}
+	var err error
+	for _, fid := range vlog.filesToBeDeleted {
+		lf := vlog.filesMap[fid]
+		delete(vlog.filesMap, fid)
+		vlog.db.log.Debugf("deleting vlog file %d rewritten by GC", fid)
+		err = utils.CombineErrors(err, lf.Delete())
+	}
+	vlog.filesToBeDeleted = nil
+	return utils.Wrapf(err, "while deleting vlog files")
+}
+
+// runGC picks a vlog file, samples it and rewrites it if enough of the sampled bytes are garbage
+func (vlog *valueLog) runGC(discardRatio float64) error {
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() {
+			<-vlog.garbageCh
+		}()
+	default:
+		return utils.ErrRejected
+	}
+
+	// prefer the file with the most garbage tracked by compaction
+	lf, ok := vlog.pickLogByDiscard(discardRatio)
+	if lf == nil && ok {
+		return utils.ErrNoRewrite
+	}
+	if lf == nil {
+		// no discard stats yet, sample a random file
+		if lf = vlog.pickRandomLog(); lf == nil {
+			return utils.ErrNoRewrite
+		}
+		total, discard, err := vlog.sample(lf)
+		if err != nil {
+			return utils.Wrapf(err, "while sampling vlog file %d", lf.Fid())
+		}
+		vlog.db.log.Debugf("sampled vlog file %d, discard %d of %d bytes", lf.Fid(), discard, total)
+		if total == 0 || float64(discard) < discardRatio*float64(total) {
+			return utils.ErrNoRewrite
+		}
+	}
+
+	if err := vlog.rewrite(lf); err != nil {
+		return utils.Wrapf(err, "while rewriting vlog file %d", lf.Fid())
+	}
+	vlog.discardStats.Update(lf.Fid(), -1)
+	return nil
+}
+
+// isGCCandidate must be called with filesLock held
+func (vlog *valueLog) isGCCandidate(fid uint32) bool {
+	_, ok := vlog.filesMap[fid]
+	return ok && fid != vlog.maxFid && !vlog.toBeDeleted(fid)
+}
+
+// pickLogByDiscard returns the GC candidate with the most discarded bytes if they are at least
+// discardRatio of the file. ok is false if there are no discard stats of the candidates.
+func (vlog *valueLog) pickLogByDiscard(discardRatio float64) (lf *storage.LogFile, ok bool) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	// the writable file often has the most garbage, but it can't be rewritten yet
+	fid, discard := vlog.discardStats.maxDiscardOf(vlog.isGCCandidate)
+	if discard == 0 {
+		return nil, false
+	}
+	lf = vlog.filesMap[fid]
+	if float64(discard) < discardRatio*float64(len(lf.Data)) {
+		return nil, true
+	}
+	return lf, true
+}
+
+// pickRandomLog randomly picks a file except the writable one and the ones waiting for deletion
+func (vlog *valueLog) pickRandomLog() *storage.LogFile {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	var candidates []*storage.LogFile
+	for fid, lf := range vlog.filesMap {
+		if vlog.isGCCandidate(fid) {
+			candidates = append(candidates, lf)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// updateDiscardStats adds the bytes of the values discarded by compaction, the stats of files
+// that are already rewritten are ignored
+func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	for fid, discard := range stats {
+		if _, ok := vlog.filesMap[fid]; ok && !vlog.toBeDeleted(fid) {
+			vlog.discardStats.Update(fid, discard)
+		}
+	}
+}
+
+// sample checks the liveness of the entries from the beginning of lf, returns the sizes of all the
+// sampled records and the dead ones
+func (vlog *valueLog) sample(lf *storage.LogFile) (total, discard int64, err error) {
+	sizeWindow := int64(float64(len(lf.Data)) * gcSampleRatio)
+	var count int
+	_, err = lf.Iterate(0, func(e *structs.Entry, vp structs.ValuePointer) error {
+		if total >= sizeWindow && count >= gcSampleCount {
+			return utils.ErrStop
+		}
+		live, err := vlog.isLive(e, vp)
+		if err != nil {
+			return err
+		}
+		count++
+		total += int64(vp.Len)
+		if !live {
+			discard += int64(vp.Len)
+		}
+		return nil
+	})
+	return total, discard, err
+}
+
+// isLive checks whether the LSM tree still points to the record at vp for the version of e
+func (vlog *valueLog) isLive(e *structs.Entry, vp structs.ValuePointer) (bool, error) {
+	vs, err := vlog.db.get(e.Key)
+	if err != nil {
+		return false, err
+	}
+	if vs.Version != utils.ParseTs(e.Key) {
+		// the version has been discarded by compaction
+		return false, nil
+	}
+	if structs.IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) || vs.Meta&structs.BitValuePointer == 0 {
+		return false, nil
+	}
+	var cur structs.ValuePointer
+	cur.Decode(vs.Value)
+	return cur == vp, nil
+}
+
+// rewrite writes the live entries of lf again through the write channel, then marks lf to be
+// deleted. The versions of the entries are kept.
+func (vlog *valueLog) rewrite(lf *storage.LogFile) error {
+	var entries []*structs.Entry
+	var size int64
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		req, err := vlog.db.sendToWriteCh(entries)
+		if err != nil {
+			return err
+		}
+		entries, size = nil, 0
+		return req.Wait()
+	}
+
+	var count int
+	_, err := lf.Iterate(0, func(e *structs.Entry, vp structs.ValuePointer) error {
+		live, err := vlog.isLive(e, vp)
+		if err != nil || !live {
+			return err
+		}
+		ne := &structs.Entry{
+			Key:       utils.SafeCopy(nil, e.Key),
+			Value:     utils.SafeCopy(nil, e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta &^ structs.BitValuePointer,
+			UserMeta:  e.UserMeta,
+		}
+		entries = append(entries, ne)
+		size += estimateRecordSize(ne)
+		count++
+		if len(entries) >= gcBatchCount || size >= gcBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	// the rewritten entries must be durable before lf is deleted
+	if err := vlog.writableFile().Sync(); err != nil {
+		return utils.Wrapf(err, "while syncing vlog file")
+	}
+	vlog.db.lock.RLock()
+	err = vlog.db.mt.SyncWal()
+	vlog.db.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	vlog.filesLock.Lock()
+	vlog.filesToBeDeleted = append(vlog.filesToBeDeleted, lf.Fid())
+	vlog.filesLock.Unlock()
+	vlog.db.log.Debugf("rewrote %d entries of vlog file %d", count, lf.Fid())
+	return vlog.deleteMarkedFiles()
+}
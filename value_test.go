@@ -0,0 +1,266 @@
+package tiny_badger
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"tiny-badger/config"
+	"tiny-badger/structs"
+	"tiny-badger/utils"
+)
+
+func largeValue(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%05d", i)), 20)
+}
+
+func TestValueLogLargeValues(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.ValueThreshold = 32
+	opts.ValueLogFileSize = 4 << 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	n := 200
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return largeValue(i)
+		}
+		return newValue(i)
+	}
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), value(i), 0x00)
+	}
+
+	// only the pointers of large values are kept in memtable
+	for i := 0; i < 2; i++ {
+		vs := db.mt.skl.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), math.MaxUint64))
+		if i%2 == 0 {
+			require.NotZero(t, vs.Meta&structs.BitValuePointer)
+			var vp structs.ValuePointer
+			vp.Decode(vs.Value)
+			require.Greater(t, vp.Len, uint32(len(largeValue(i))))
+		} else {
+			require.Zero(t, vs.Meta&structs.BitValuePointer)
+			require.Equal(t, newValue(i), vs.Value)
+		}
+	}
+
+	check := func(db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i), getItemValue(t, item))
+		}
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+vlogFileExt))
+	require.NoError(t, err)
+	require.Greater(t, len(files), 1)
+
+	// the pointers are flushed to L0 tables
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	check(db)
+}
+
+func TestValueLogTooLarge(t *testing.T) {
+	opts := config.DefaultOptions("")
+	opts.ValueThreshold = 32
+	opts.ValueLogFileSize = 1 << 10
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.Error(t, txn.Set([]byte("key"), make([]byte, opts.ValueLogFileSize)))
+	})
+}
+
+func TestValueLogTornFile(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.ValueThreshold = 32
+	db, err := Open(opts)
+	require.NoError(t, err)
+	txnSet(t, db, []byte("key"), largeValue(1), 0x00)
+	require.NoError(t, db.Close())
+
+	// append garbage to the vlog file as if a write was torn
+	path := vlogFilePath(dir, 1)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	fi2, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), fi2.Size())
+
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	item, err := txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, largeValue(1), getItemValue(t, item))
+}
+
+func TestValueLogGC(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.ValueThreshold = 32
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	n := 100
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), largeValue(i), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	// the writes after reopening go to a new vlog file
+	db, err = Open(opts)
+	require.NoError(t, err)
+	// all the sampled values are alive
+	require.Equal(t, utils.ErrNoRewrite, db.RunValueLogGC(0.5))
+
+	// overwrite half of the keys
+	for i := 0; i < n; i += 2 {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), largeValue(i+n), 0x00)
+	}
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return largeValue(i + n)
+		}
+		return largeValue(i)
+	}
+	require.NoError(t, db.Close())
+
+	// the old versions are dropped by compaction, which counts the discarded bytes
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.lc.doCompact(0))
+	require.EqualValues(t, 1, func() uint32 {
+		fid, _ := db.vlog.discardStats.MaxDiscard()
+		return fid
+	}())
+	require.Equal(t, utils.ErrNoRewrite, db.RunValueLogGC(0.9))
+
+	// the transaction started before GC still reads the old file
+	txn := db.NewTransaction(true)
+	item, err := txn.Get([]byte("key00001"))
+	require.NoError(t, err)
+
+	require.NoError(t, db.RunValueLogGC(0.3))
+	path := vlogFilePath(dir, 1)
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, largeValue(1), getItemValue(t, item))
+	txn.Discard()
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	txn = db.NewTransaction(true)
+	defer txn.Discard()
+	for i := 0; i < n; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+		require.Equal(t, value(i), getItemValue(t, item))
+	}
+}
+
+func TestValueLogGCSkipsWritableFile(t *testing.T) {
+	dir := utils.CreateTmpDir("badger-test")
+	defer utils.DestroyDir(dir)
+
+	opts := config.DefaultOptions(dir)
+	opts.ValueThreshold = 32
+	opts.NumCompactors = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	n := 100
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), largeValue(i), 0x00)
+	}
+	require.NoError(t, db.Close())
+
+	// the writes after reopening go to a new vlog file
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for i := 0; i < n; i += 2 {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), largeValue(i+n), 0x00)
+	}
+
+	// half of the old file is garbage, but the writable file has even more
+	db.vlog.filesLock.RLock()
+	maxFid := db.vlog.maxFid
+	size := int64(len(db.vlog.filesMap[1].Data))
+	db.vlog.filesLock.RUnlock()
+	require.NotEqualValues(t, 1, maxFid)
+	db.vlog.discardStats.Update(1, size/2)
+	db.vlog.discardStats.Update(maxFid, size)
+	fid, _ := db.vlog.discardStats.MaxDiscard()
+	require.Equal(t, maxFid, fid)
+
+	require.NoError(t, db.RunValueLogGC(0.3))
+	db.vlog.filesLock.RLock()
+	require.True(t, db.vlog.toBeDeleted(1) || db.vlog.filesMap[1] == nil)
+	db.vlog.filesLock.RUnlock()
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	for i := 0; i < n; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+		want := largeValue(i)
+		if i%2 == 0 {
+			want = largeValue(i + n)
+		}
+		require.Equal(t, want, getItemValue(t, item))
+	}
+}
+
+func TestValueLogGCInvalidRequest(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, utils.ErrInvalidRequest, db.RunValueLogGC(0))
+		require.Equal(t, utils.ErrInvalidRequest, db.RunValueLogGC(1))
+		require.Equal(t, utils.ErrNoRewrite, db.RunValueLogGC(0.5))
+	})
+
+	opts := config.DefaultOptions("")
+	opts.InMemory = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, utils.ErrGCInMemoryMode, db.RunValueLogGC(0.5))
+}